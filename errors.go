@@ -0,0 +1,54 @@
+package goheif
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/jdeng/goheif/heif"
+	"github.com/jdeng/goheif/libde265"
+)
+
+// Errors returned by this package wrap one of the following, so they can
+// be classified with errors.Is. Failures tied to an item are reported as
+// a *heif.ItemError, failures tied to a box as a *bmff.BoxError, and
+// failures of the codec as a *libde265.Error; use errors.As to get at
+// the item ID, box offset or de265 error code.
+var (
+	// ErrUnsupported is wrapped by errors for valid files using features
+	// that are not implemented, such as item types other than hvc1 and grid.
+	ErrUnsupported = heif.ErrUnsupported
+
+	// ErrCorrupt is wrapped by errors for truncated or malformed files.
+	ErrCorrupt = heif.ErrCorrupt
+
+	// ErrTruncated is wrapped, along with ErrCorrupt, by errors for coded
+	// image data that ends early.
+	ErrTruncated = libde265.ErrTruncated
+
+	// ErrCodec is wrapped by errors reported by libde265.
+	ErrCodec = libde265.ErrCodec
+
+	// ErrChecksumMismatch is wrapped by the error for an image that does
+	// not match its decoded picture hash, see DecodeOptions.VerifyHash.
+	ErrChecksumMismatch = libde265.ErrChecksumMismatch
+
+	// ErrLimitExceeded is returned when a decode would exceed its Limits.
+	ErrLimitExceeded = heif.ErrLimitExceeded
+
+	// ErrInvalidOptions is wrapped by the error for DecodeOptions that
+	// cannot be combined, such as VerifyHash with FastPreview.
+	ErrInvalidOptions = errors.New("goheif: invalid options")
+)
+
+// codecError classifies a libde265 error like the container errors: codec
+// features libde265 lacks are ErrUnsupported, and truncated or malformed
+// bitstreams are ErrCorrupt.
+func codecError(err error) error {
+	switch {
+	case errors.Is(err, libde265.ErrUnsupported):
+		return fmt.Errorf("%w: %w", ErrUnsupported, err)
+	case errors.Is(err, libde265.ErrTruncated), errors.Is(err, libde265.ErrInvalidBitstream):
+		return fmt.Errorf("%w: %w", ErrCorrupt, err)
+	}
+	return err
+}
@@ -1,6 +1,6 @@
 module github.com/jdeng/goheif
 
-go 1.16
+go 1.21
 
 require (
 	github.com/rwcarlsen/goexif v0.0.0-20190401172101-9e8deecbddbd
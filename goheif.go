@@ -2,18 +2,25 @@ package goheif
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"image"
 	"image/color"
 	"io"
 	"io/ioutil"
+	"sync"
 
 	"github.com/jdeng/goheif/heif"
+	"github.com/jdeng/goheif/hevc"
 	"github.com/jdeng/goheif/libde265"
 )
 
 // SafeEncoding uses more memory but seems to make
 // the library safer to use in containers.
+//
+// Deprecated: changing it affects every concurrent Decode. Use
+// DecodeWithOptions with DecodeOptions.SafeEncoding instead.
 var SafeEncoding bool
 
 type gridBox struct {
@@ -23,7 +30,7 @@ type gridBox struct {
 
 func newGridBox(data []byte) (*gridBox, error) {
 	if len(data) < 8 {
-		return nil, fmt.Errorf("invalid data")
+		return nil, fmt.Errorf("Invalid grid data: %w", ErrCorrupt)
 	}
 	// version := data[0]
 	flags := data[1]
@@ -33,7 +40,7 @@ func newGridBox(data []byte) (*gridBox, error) {
 	var width, height int
 	if (flags & 1) != 0 {
 		if len(data) < 12 {
-			return nil, fmt.Errorf("invalid data")
+			return nil, fmt.Errorf("Invalid grid data: %w", ErrCorrupt)
 		}
 
 		width = int(data[4])<<24 | int(data[5])<<16 | int(data[6])<<8 | int(data[7])
@@ -46,35 +53,87 @@ func newGridBox(data []byte) (*gridBox, error) {
 	return &gridBox{columns: columns, rows: rows, width: width, height: height}, nil
 }
 
-func decodeHevcItem(dec *libde265.Decoder, hf *heif.File, item *heif.Item) (*image.YCbCr, error) {
+// decoder holds the state of a single call to DecodeWithOptionsContext.
+type decoder struct {
+	ctx  context.Context
+	hf   *heif.File
+	opts *DecodeOptions
+
+	mu       sync.Mutex // protects warnings when decoding tiles concurrently
+	warnings []Warning
+}
+
+func (d *decoder) newDecoder() (*libde265.Decoder, error) {
+	return libde265.NewDecoder(
+		libde265.WithSafeEncoding(d.opts.SafeEncoding),
+		// libde265 only allocates through Go with worker threads; without
+		// them, the pictures are copied out of its own buffers
+		libde265.WithGoAllocation(d.opts.DecoderThreads > 0),
+		libde265.WithThreads(d.opts.DecoderThreads),
+		libde265.WithHashVerification(d.opts.VerifyHash),
+		libde265.WithDisableDeblocking(d.opts.FastPreview),
+		libde265.WithDisableSAO(d.opts.FastPreview),
+	)
+}
+
+// collectWarnings records the warnings of the last image decoded by dec.
+func (d *decoder) collectWarnings(dec *libde265.Decoder, item *heif.Item) {
+	ws := dec.Warnings()
+	if len(ws) == 0 {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, w := range ws {
+		warning := Warning{ItemID: item.ID, Code: w.Code, Text: w.Text}
+		d.warnings = append(d.warnings, warning)
+		if d.opts.OnWarning != nil {
+			d.opts.OnWarning(warning)
+		}
+	}
+}
+
+// decodeHevcItem decodes a coded item. The picture must be released once
+// its image has been used, unless it is returned to the caller.
+func (d *decoder) decodeHevcItem(dec *libde265.Decoder, item *heif.Item) (*libde265.Picture, error) {
+	data, err := d.hf.GetItemData(item)
+	if err != nil {
+		return nil, err
+	}
+
+	return d.decodeHevcData(dec, item, data)
+}
+
+func (d *decoder) decodeHevcData(dec *libde265.Decoder, item *heif.Item, data []byte) (*libde265.Picture, error) {
 	if item.Info.ItemType != "hvc1" {
-		return nil, fmt.Errorf("Unsupported item type: %s", item.Info.ItemType)
+		return nil, &heif.ItemError{ItemID: item.ID, Err: fmt.Errorf("Unsupported item type %q: %w", item.Info.ItemType, ErrUnsupported)}
 	}
 
 	hvcc, ok := item.HevcConfig()
 	if !ok {
-		return nil, fmt.Errorf("No hvcC")
+		return nil, &heif.ItemError{ItemID: item.ID, Err: fmt.Errorf("No hvcC: %w", ErrCorrupt)}
 	}
 
 	hdr := hvcc.AsHeader()
-	data, err := hf.GetItemData(item)
-	if err != nil {
-		return nil, err
-	}
 
 	dec.Reset()
-	dec.Push(hdr)
-	tile, err := dec.DecodeImage(data)
-	if err != nil {
+	if err := dec.Push(hdr); err != nil {
+		return nil, &heif.ItemError{ItemID: item.ID, Err: err}
+	}
+	if err := dec.PushLengthPrefixed(data, hvcc.LengthSize(), 0, nil); err != nil {
+		return nil, &heif.ItemError{ItemID: item.ID, Err: err}
+	}
+	pic, err := dec.DecodePicture(d.ctx, nil)
+	d.collectWarnings(dec, item)
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
 		return nil, err
 	}
-
-	ycc, ok := tile.(*image.YCbCr)
-	if !ok {
-		return nil, fmt.Errorf("Tile is not YCbCr")
+	if err != nil {
+		return nil, &heif.ItemError{ItemID: item.ID, Err: codecError(err)}
 	}
 
-	return ycc, nil
+	return pic, nil
 }
 
 func ExtractExif(ra io.ReaderAt) ([]byte, error) {
@@ -82,39 +141,225 @@ func ExtractExif(ra io.ReaderAt) ([]byte, error) {
 	return hf.EXIF()
 }
 
+// Decode decodes the primary image of a HEIF file with the default
+// options. It honours the deprecated SafeEncoding variable. Like with
+// every decode, the image is cropped by the clap property of the primary
+// item, if any.
 func Decode(r io.Reader) (image.Image, error) {
+	return DecodeContext(context.Background(), r)
+}
+
+// DecodeContext is like Decode but stops with ctx.Err() once ctx is done.
+func DecodeContext(ctx context.Context, r io.Reader) (image.Image, error) {
+	return DecodeWithOptionsContext(ctx, r, &DecodeOptions{SafeEncoding: SafeEncoding})
+}
+
+// DecodeWithOptions decodes the primary image of a HEIF file. A nil opts
+// is the same as the zero DecodeOptions.
+func DecodeWithOptions(r io.Reader, opts *DecodeOptions) (image.Image, error) {
+	return DecodeWithOptionsContext(context.Background(), r, opts)
+}
+
+// DecodeWithOptionsContext is like DecodeWithOptions but stops with
+// ctx.Err() once ctx is done. Cancellation is checked between grid tiles
+// and between the decoding steps of a single image.
+func DecodeWithOptionsContext(ctx context.Context, r io.Reader, opts *DecodeOptions) (image.Image, error) {
+	img, _, err := DecodeWithWarnings(ctx, r, opts)
+	return img, err
+}
+
+// DecodeWithWarnings is like DecodeWithOptionsContext but also returns
+// the warnings reported by the decoder. Warnings are returned even if
+// the decode fails.
+func DecodeWithWarnings(ctx context.Context, r io.Reader, opts *DecodeOptions) (image.Image, []Warning, error) {
+	if opts == nil {
+		opts = &DecodeOptions{}
+	}
+	if opts.VerifyHash && opts.FastPreview {
+		return nil, nil, fmt.Errorf("%w: VerifyHash cannot be combined with FastPreview", ErrInvalidOptions)
+	}
+
 	ra, err := asReaderAt(r)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	hf := heif.Open(ra)
+	d := &decoder{
+		ctx:  ctx,
+		hf:   heif.Open(ra, heif.WithLimits(opts.Limits.heif())),
+		opts: opts,
+	}
+	img, err := d.decode()
+	return img, d.warnings, err
+}
 
-	it, err := hf.PrimaryItem()
+func (d *decoder) decode() (image.Image, error) {
+	it, err := d.hf.PrimaryItem()
 	if err != nil {
 		return nil, err
 	}
 
-	width, height, ok := it.SpatialExtents()
+	ycc, err := d.decodePrimary(it)
+	if err != nil {
+		return nil, err
+	}
+
+	// the crop comes first, before any rotation or mirroring
+	if ycc, err = applyCleanAperture(ycc, it); err != nil {
+		return nil, err
+	}
+
+	if d.opts.ApplyTransformations {
+		if ycc, err = applyTransformations(ycc, it); err != nil {
+			return nil, err
+		}
+	}
+
+	return convertFormat(ycc, d.opts.Format)
+}
+
+func checkPixels(width, height int, limits *Limits) error {
+	if limits.MaxPixels > 0 && int64(width)*int64(height) > limits.MaxPixels {
+		return fmt.Errorf("Image of %dx%d exceeds the limit of %d pixels: %w", width, height, limits.MaxPixels, ErrLimitExceeded)
+	}
+	return nil
+}
+
+// itemSize returns the size of an item from its ispe property. Items
+// lacking one, which MIAF forbids but some encoders write, get the size of
+// their coded image instead: the SPS size within the conformance window
+// for hvc1, and the output size for grids.
+func itemSize(hf *heif.File, it *heif.Item) (int, int, error) {
+	if width, height, ok := it.SpatialExtents(); ok {
+		return width, height, nil
+	}
+
+	var itemType string
+	if it.Info != nil {
+		itemType = it.Info.ItemType
+	}
+	switch itemType {
+	case "hvc1":
+		hvcc, ok := it.HevcConfig()
+		if !ok {
+			break
+		}
+		for _, nal := range hvcc.NalUnits(hevc.NALUnitSPS) {
+			sps, err := hevc.ParseSPS(nal)
+			if err != nil {
+				return 0, 0, &heif.ItemError{ItemID: it.ID, Err: fmt.Errorf("No dimension, %v: %w", err, ErrCorrupt)}
+			}
+			width, height := sps.DisplaySize()
+			return width, height, nil
+		}
+	case "grid":
+		data, err := hf.GetItemData(it)
+		if err != nil {
+			return 0, 0, err
+		}
+		grid, err := newGridBox(data)
+		if err != nil {
+			return 0, 0, &heif.ItemError{ItemID: it.ID, Err: err}
+		}
+		return grid.width, grid.height, nil
+	}
+	return 0, 0, &heif.ItemError{ItemID: it.ID, Err: fmt.Errorf("No dimension: %w", ErrCorrupt)}
+}
+
+// codedSize returns the largest coded size of the SPS in the hvcC property
+// of an hvc1 item, which is what libde265 allocates regardless of ispe.
+func codedSize(it *heif.Item) (int, int, error) {
+	hvcc, ok := it.HevcConfig()
 	if !ok {
-		return nil, fmt.Errorf("No dimension")
+		return 0, 0, &heif.ItemError{ItemID: it.ID, Err: fmt.Errorf("No hvcC: %w", ErrCorrupt)}
+	}
+	var width, height int
+	for _, nal := range hvcc.NalUnits(hevc.NALUnitSPS) {
+		sps, err := hevc.ParseSPS(nal)
+		if err != nil {
+			return 0, 0, &heif.ItemError{ItemID: it.ID, Err: fmt.Errorf("Invalid SPS, %v: %w", err, ErrCorrupt)}
+		}
+		width, height = max(width, sps.Width), max(height, sps.Height)
+	}
+	if width == 0 || height == 0 {
+		return 0, 0, &heif.ItemError{ItemID: it.ID, Err: fmt.Errorf("No SPS: %w", ErrCorrupt)}
+	}
+	return width, height, nil
+}
+
+// estimatedPlaneBytes is the size of the planes libde265 allocates for
+// a picture, assuming the usual 8 bit 4:2:0.
+func estimatedPlaneBytes(width, height int) int64 {
+	return int64(width) * int64(height) * 3 / 2
+}
+
+// newCanvas is like image.NewYCbCr, but leaves the padding after each
+// plane that libde265.SetTarget requires.
+func newCanvas(r image.Rectangle, ratio image.YCbCrSubsampleRatio) *image.YCbCr {
+	w, h := r.Dx(), r.Dy()
+	cw, ch := chromaSize(r, ratio)
+	plane := func(n int) []byte {
+		return make([]byte, n, n+libde265.PlanePadding)
+	}
+	return &image.YCbCr{
+		Y:              plane(w * h),
+		Cb:             plane(cw * ch),
+		Cr:             plane(cw * ch),
+		YStride:        w,
+		CStride:        cw,
+		SubsampleRatio: ratio,
+		Rect:           r,
+	}
+}
+
+func (d *decoder) decodePrimary(it *heif.Item) (*image.YCbCr, error) {
+	hf, opts := d.hf, d.opts
+	itemError := func(err error) error {
+		return &heif.ItemError{ItemID: it.ID, Err: err}
+	}
+
+	width, height, err := itemSize(hf, it)
+	if err != nil {
+		return nil, err
 	}
 
 	if it.Info == nil {
-		return nil, fmt.Errorf("No item info")
+		return nil, itemError(fmt.Errorf("No item info: %w", ErrCorrupt))
+	}
+
+	if err := checkPixels(width, height, &opts.Limits); err != nil {
+		return nil, err
 	}
 
-	dec, err := libde265.NewDecoder(libde265.WithSafeEncoding(SafeEncoding))
+	if it.Info.ItemType == "hvc1" {
+		codedWidth, codedHeight, err := codedSize(it)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkPixels(codedWidth, codedHeight, &opts.Limits); err != nil {
+			return nil, err
+		}
+		if err := hf.Reserve(estimatedPlaneBytes(codedWidth, codedHeight)); err != nil {
+			return nil, err
+		}
+	}
+
+	dec, err := d.newDecoder()
 	if err != nil {
 		return nil, err
 	}
 	defer dec.Free()
 	if it.Info.ItemType == "hvc1" {
-		return decodeHevcItem(dec, hf, it)
+		pic, err := d.decodeHevcItem(dec, it)
+		if err != nil {
+			return nil, err
+		}
+		// out of libde265's buffers before the deferred Free
+		return pic.Detach(), nil
 	}
 
 	if it.Info.ItemType != "grid" {
-		return nil, fmt.Errorf("No grid")
+		return nil, itemError(fmt.Errorf("No grid, item type %q: %w", it.Info.ItemType, ErrUnsupported))
 	}
 
 	data, err := hf.GetItemData(it)
@@ -124,60 +369,120 @@ func Decode(r io.Reader) (image.Image, error) {
 
 	grid, err := newGridBox(data)
 	if err != nil {
-		return nil, err
+		return nil, itemError(err)
+	}
+
+	if max := opts.Limits.MaxTiles; max > 0 && grid.columns*grid.rows > max {
+		return nil, fmt.Errorf("Grid of %d tiles exceeds the limit of %d tiles: %w", grid.columns*grid.rows, max, ErrLimitExceeded)
 	}
 
 	dimg := it.Reference("dimg")
 	if dimg == nil {
-		return nil, fmt.Errorf("No dimg")
+		return nil, itemError(fmt.Errorf("No dimg: %w", ErrCorrupt))
 	}
 
 	if len(dimg.ToItemIDs) != grid.columns*grid.rows {
-		return nil, fmt.Errorf("Tiles number not matched")
+		return nil, itemError(fmt.Errorf("Tiles number not matched: %w", ErrCorrupt))
 	}
 
-	var out *image.YCbCr
-	var tileWidth, tileHeight int
-	for i, y := 0, 0; y < grid.rows; y += 1 {
-		for x := 0; x < grid.columns; x += 1 {
-			id := dimg.ToItemIDs[i]
-			item, err := hf.ItemByID(id)
-			if err != nil {
-				return nil, err
-			}
+	tiles := make([]*heif.Item, len(dimg.ToItemIDs))
+	for i, id := range dimg.ToItemIDs {
+		if tiles[i], err = hf.ItemByID(id); err != nil {
+			return nil, err
+		}
+	}
 
-			ycc, err := decodeHevcItem(dec, hf, item)
-			if err != nil {
-				return nil, err
-			}
+	// every decoder holds one tile at a time
+	var cellWidth, cellHeight int
+	for _, tile := range tiles {
+		if tile.Info == nil || tile.Info.ItemType != "hvc1" {
+			continue // fails when decoded
+		}
+		w, h, err := codedSize(tile)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkPixels(w, h, &opts.Limits); err != nil {
+			return nil, err
+		}
+		cellWidth, cellHeight = max(cellWidth, w), max(cellHeight, h)
+	}
+	decoders := opts.threads()
+	if decoders > len(tiles) {
+		decoders = len(tiles)
+	}
+	if err := hf.Reserve(estimatedPlaneBytes(cellWidth, cellHeight) * int64(decoders)); err != nil {
+		return nil, err
+	}
 
-			rect := ycc.Bounds()
-			if tileWidth == 0 {
-				tileWidth, tileHeight = rect.Dx(), rect.Dy()
-				width, height := tileWidth*grid.columns, tileHeight*grid.rows
-				out = image.NewYCbCr(image.Rectangle{image.Pt(0, 0), image.Pt(width, height)}, ycc.SubsampleRatio)
-			}
+	// the first tile determines the tile size and the canvas layout
+	pic, err := d.decodeHevcItem(dec, tiles[0])
+	if err != nil {
+		return nil, err
+	}
+	defer pic.Release()
+	first := pic.Image()
 
-			if tileWidth != rect.Dx() || tileHeight != rect.Dy() {
-				return nil, fmt.Errorf("Inconsistent tile dimensions")
-			}
+	tileWidth, tileHeight := first.Rect.Dx(), first.Rect.Dy()
+	canvas := image.Rect(0, 0, tileWidth*grid.columns, tileHeight*grid.rows)
+	if canvas.Dx() < width || canvas.Dy() < height {
+		return nil, itemError(fmt.Errorf("Tiles do not cover the image: %w", ErrCorrupt))
+	}
+	if err := checkPixels(canvas.Dx(), canvas.Dy(), &opts.Limits); err != nil {
+		return nil, err
+	}
+	cw, ch := chromaSize(canvas, first.SubsampleRatio)
+	if err := hf.Reserve(int64(canvas.Dx())*int64(canvas.Dy()) + 2*int64(cw)*int64(ch)); err != nil {
+		return nil, err
+	}
+	out := newCanvas(canvas, first.SubsampleRatio)
 
-			// copy y stride data
-			for i := 0; i < rect.Dy(); i += 1 {
-				copy(out.Y[(y*tileHeight+i)*out.YStride+x*ycc.YStride:], ycc.Y[i*ycc.YStride:(i+1)*ycc.YStride])
-			}
+	// tiles are decoded straight into the canvas where possible
+	tileRect := func(i int) image.Rectangle {
+		x, y := i%grid.columns, i/grid.columns
+		return image.Rect(x*tileWidth, y*tileHeight, (x+1)*tileWidth, (y+1)*tileHeight)
+	}
+
+	copyTile := func(i int, pic *libde265.Picture) error {
+		ycc := pic.Image()
+		rect := ycc.Bounds()
+		if tileWidth != rect.Dx() || tileHeight != rect.Dy() {
+			return &heif.ItemError{ItemID: tiles[i].ID, Err: fmt.Errorf("Inconsistent tile dimensions: %w", ErrCorrupt)}
+		}
+		if ycc.SubsampleRatio != out.SubsampleRatio {
+			return &heif.ItemError{ItemID: tiles[i].ID, Err: fmt.Errorf("Inconsistent tile subsample ratio: %w", ErrCorrupt)}
+		}
+		if pic.InTarget() {
+			return nil
+		}
 
-			// height of c strides
-			cHeight := len(ycc.Cb) / ycc.CStride
+		x, y := i%grid.columns, i/grid.columns
 
-			// copy c stride data
-			for i := 0; i < cHeight; i += 1 {
-				copy(out.Cb[(y*cHeight+i)*out.CStride+x*ycc.CStride:], ycc.Cb[i*ycc.CStride:(i+1)*ycc.CStride])
-				copy(out.Cr[(y*cHeight+i)*out.CStride+x*ycc.CStride:], ycc.Cr[i*ycc.CStride:(i+1)*ycc.CStride])
-			}
+		// copy y stride data
+		for i := 0; i < tileHeight; i += 1 {
+			copy(out.Y[(y*tileHeight+i)*out.YStride+x*tileWidth:], ycc.Y[i*ycc.YStride:i*ycc.YStride+tileWidth])
+		}
 
-			i += 1
+		// size of the c planes
+		cWidth, cHeight := chromaSize(rect, ycc.SubsampleRatio)
+
+		// copy c stride data
+		for i := 0; i < cHeight; i += 1 {
+			copy(out.Cb[(y*cHeight+i)*out.CStride+x*cWidth:], ycc.Cb[i*ycc.CStride:i*ycc.CStride+cWidth])
+			copy(out.Cr[(y*cHeight+i)*out.CStride+x*cWidth:], ycc.Cr[i*ycc.CStride:i*ycc.CStride+cWidth])
 		}
+		return nil
+	}
+
+	if err := copyTile(0, pic); err != nil {
+		return nil, err
+	}
+	pic.Release() // before dec decodes the next tile
+
+	if err := d.decodeTiles(dec, tiles, func(dec *libde265.Decoder, i int) {
+		dec.SetTarget(out, tileRect(i))
+	}, copyTile); err != nil {
+		return nil, err
 	}
 
 	//crop to actual size when applicable
@@ -185,6 +490,101 @@ func Decode(r io.Reader) (image.Image, error) {
 	return out, nil
 }
 
+// decodeTiles decodes tiles[1:] and hands each one to copyTile, after
+// calling target with the decoder of the tile. With more than one thread,
+// the tiles are spread over additional decoders; target and copyTile
+// are called from the goroutine that decoded the tile, before its decoder
+// moves on to the next one.
+func (d *decoder) decodeTiles(dec *libde265.Decoder, tiles []*heif.Item, target func(*libde265.Decoder, int), copyTile func(int, *libde265.Picture) error) error {
+	ctx := d.ctx
+	threads := d.opts.threads()
+	if threads == 1 || len(tiles) < 3 {
+		for i := 1; i < len(tiles); i++ {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			target(dec, i)
+			pic, err := d.decodeHevcItem(dec, tiles[i])
+			if err != nil {
+				return err
+			}
+			err = copyTile(i, pic)
+			pic.Release()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if threads > len(tiles)-1 {
+		threads = len(tiles) - 1
+	}
+
+	// the item data is read up front since File is not safe for
+	// concurrent use.
+	data := make([][]byte, len(tiles))
+	for i := 1; i < len(tiles); i++ {
+		var err error
+		if data[i], err = d.hf.GetItemData(tiles[i]); err != nil {
+			return err
+		}
+	}
+
+	jobs := make(chan int)
+	errs := make(chan error, threads)
+	for w := 0; w < threads; w++ {
+		go func(dec *libde265.Decoder) {
+			var err error
+			for i := range jobs {
+				if err != nil {
+					continue // drain
+				}
+				if err = ctx.Err(); err != nil {
+					continue
+				}
+				target(dec, i)
+				var pic *libde265.Picture
+				if pic, err = d.decodeHevcData(dec, tiles[i], data[i]); err == nil {
+					err = copyTile(i, pic)
+					pic.Release()
+				}
+			}
+			errs <- err
+		}(dec)
+
+		if w+1 < threads {
+			var err error
+			if dec, err = d.newDecoder(); err != nil {
+				threads = w + 1
+				break
+			}
+			defer dec.Free()
+		}
+	}
+
+feed:
+	for i := 1; i < len(tiles); i++ {
+		select {
+		case jobs <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+
+	var err error
+	for w := 0; w < threads; w++ {
+		if werr := <-errs; werr != nil && err == nil {
+			err = werr
+		}
+	}
+	if err == nil {
+		err = ctx.Err()
+	}
+	return err
+}
+
 func DecodeConfig(r io.Reader) (image.Config, error) {
 	var config image.Config
 
@@ -200,15 +600,19 @@ func DecodeConfig(r io.Reader) (image.Config, error) {
 		return config, err
 	}
 
-	width, height, ok := it.SpatialExtents()
-	if !ok {
-		return config, fmt.Errorf("No dimension")
+	width, height, err := itemSize(hf, it)
+	if err != nil {
+		return config, err
+	}
+	crop, err := cleanAperture(it, width, height)
+	if err != nil {
+		return config, err
 	}
 
 	config = image.Config{
 		ColorModel: color.YCbCrModel,
-		Width:      width,
-		Height:     height,
+		Width:      crop.Dx(),
+		Height:     crop.Dy(),
 	}
 	return config, nil
 }
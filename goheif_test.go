@@ -2,10 +2,15 @@ package goheif
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"image"
 	"io"
 	"io/ioutil"
 	"testing"
+
+	"github.com/jdeng/goheif/heif"
+	"github.com/jdeng/goheif/libde265"
 )
 
 func TestFormatRegistered(t *testing.T) {
@@ -28,6 +33,48 @@ func TestFormatRegistered(t *testing.T) {
 	}
 }
 
+func TestDecodeConfigWithoutIspe(t *testing.T) {
+	camel, err := ioutil.ReadFile("testdata/camel.heic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	park, err := ioutil.ReadFile("heif/testdata/park.heic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		file          string
+		b             []byte
+		width, height int
+		decode        bool // the test file of park is cut off
+	}{
+		{"testdata/camel.heic", camel, 1596, 1064, true},
+		{"heif/testdata/park.heic", park, 4032, 3024, false},
+		{"2x2 grid", writeGrid(t, 2, 2, nil), 2 * 1596, 2 * 1064, true},
+	} {
+		// hide the ispe properties behind an unknown box type
+		b := bytes.ReplaceAll(tt.b, []byte("ispe"), []byte("xspe"))
+
+		config, err := DecodeConfig(bytes.NewReader(b))
+		if err != nil {
+			t.Fatalf("%s: DecodeConfig: %v", tt.file, err)
+		}
+		if config.Width != tt.width || config.Height != tt.height {
+			t.Errorf("%s: DecodeConfig = %dx%d; want %dx%d", tt.file, config.Width, config.Height, tt.width, tt.height)
+		}
+		if !tt.decode {
+			continue
+		}
+		img, err := Decode(bytes.NewReader(b))
+		if err != nil {
+			t.Fatalf("%s: Decode: %v", tt.file, err)
+		}
+		if got, want := img.Bounds().Size(), image.Pt(tt.width, tt.height); got != want {
+			t.Errorf("%s: Decode = %v; want %v", tt.file, got, want)
+		}
+	}
+}
+
 func BenchmarkSafeEncoding(b *testing.B) {
 	benchEncoding(b, true)
 }
@@ -58,3 +105,432 @@ func benchEncoding(b *testing.B, safe bool) {
 		r.Seek(0, io.SeekStart)
 	}
 }
+
+func BenchmarkDecodeWithOptions(b *testing.B) {
+	f, err := ioutil.ReadFile("testdata/camel.heic")
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, bb := range []struct {
+		name string
+		opts *DecodeOptions
+	}{
+		// copied out of libde265's buffers
+		{"Default", &DecodeOptions{}},
+		{"SafeEncoding", &DecodeOptions{SafeEncoding: true}},
+		// decoded into Go memory
+		{"DecoderThreads", &DecodeOptions{DecoderThreads: 1}},
+		{"RGBA", &DecodeOptions{Format: PixelFormatRGBA}},
+	} {
+		b.Run(bb.name, func(b *testing.B) {
+			r := bytes.NewReader(f)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := DecodeWithOptions(r, bb.opts); err != nil {
+					b.Fatal(err)
+				}
+				r.Seek(0, io.SeekStart)
+			}
+		})
+	}
+}
+
+// testTile returns the image of testdata/camel.heic.
+func testTile(t *testing.T) *heif.Image {
+	t.Helper()
+	b, err := ioutil.ReadFile("testdata/camel.heic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := heif.Open(bytes.NewReader(b))
+	it, err := src.PrimaryItem()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hvcc, _ := it.HevcConfig()
+	data, err := src.GetItemData(it)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, h, _ := it.SpatialExtents()
+	return &heif.Image{Width: w, Height: h, Config: hvcc, Data: data}
+}
+
+// writeGrid returns a file whose primary image is a grid of rows by
+// columns tiles, each of them tile, or testTile if nil.
+func writeGrid(t *testing.T, rows, columns int, tile *heif.Image) []byte {
+	t.Helper()
+	if tile == nil {
+		tile = testTile(t)
+	}
+	grid := &heif.Grid{Rows: rows, Columns: columns, Width: columns * tile.Width, Height: rows * tile.Height}
+	for i := 0; i < rows*columns; i++ {
+		grid.Tiles = append(grid.Tiles, tile)
+	}
+	hw := heif.NewWriter()
+	if _, err := hw.AddGrid(grid); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if _, err := hw.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDecodeWithOptions(t *testing.T) {
+	camel, err := ioutil.ReadFile("testdata/camel.heic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		fn string
+		b  []byte
+	}{
+		{"testdata/camel.heic", camel},
+		{"2x2 grid", writeGrid(t, 2, 2, nil)},
+	} {
+		fn, b := tt.fn, tt.b
+
+		want, err := Decode(bytes.NewReader(b))
+		if err != nil {
+			t.Fatalf("%s: Decode: %v", fn, err)
+		}
+
+		for _, opts := range []*DecodeOptions{
+			{Threads: 4},
+			{SafeEncoding: true, Threads: 2},
+			{DecoderThreads: 4},
+			{VerifyHash: true},
+			{FastPreview: true, Threads: 4},
+			{Format: PixelFormatRGBA},
+			{Format: PixelFormatGray},
+		} {
+			img, err := DecodeWithOptions(bytes.NewReader(b), opts)
+			if err != nil {
+				t.Fatalf("%s: DecodeWithOptions(%+v): %v", fn, opts, err)
+			}
+			if got := img.Bounds().Size(); got != want.Bounds().Size() {
+				t.Errorf("%s: DecodeWithOptions(%+v) size = %v; want %v", fn, opts, got, want.Bounds().Size())
+			}
+			if opts.Format != PixelFormatYCbCr || opts.FastPreview {
+				continue
+			}
+			ycc, wycc := img.(*image.YCbCr), want.(*image.YCbCr)
+			for y := 0; y < ycc.Rect.Dy(); y++ {
+				row := ycc.Y[ycc.YOffset(ycc.Rect.Min.X, ycc.Rect.Min.Y+y):][:ycc.Rect.Dx()]
+				wrow := wycc.Y[wycc.YOffset(wycc.Rect.Min.X, wycc.Rect.Min.Y+y):][:wycc.Rect.Dx()]
+				if !bytes.Equal(row, wrow) {
+					t.Fatalf("%s: DecodeWithOptions(%+v): luma row %d differs", fn, opts, y)
+				}
+			}
+		}
+	}
+}
+
+func TestDecodeLimits(t *testing.T) {
+	for _, tt := range []struct {
+		fn     string
+		limits Limits
+	}{
+		{"testdata/camel.heic", Limits{MaxPixels: 1000}},
+		{"testdata/camel.heic", Limits{MaxItemDataSize: 1000}},
+		{"testdata/camel.heic", Limits{MaxTotalBytes: 1 << 20}},
+		{"testdata/camel.heic", Limits{MaxBoxes: 10}},
+		{"heif/testdata/park.heic", Limits{MaxTiles: 2}},
+	} {
+		b, err := ioutil.ReadFile(tt.fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := DecodeWithOptions(bytes.NewReader(b), &DecodeOptions{Limits: tt.limits}); !errors.Is(err, ErrLimitExceeded) {
+			t.Errorf("%s: DecodeWithOptions with %+v = %v; want ErrLimitExceeded", tt.fn, tt.limits, err)
+		}
+	}
+}
+
+func TestDecodeLimitsCodedSize(t *testing.T) {
+	// ispe properties claiming 1x1 pixels, for the limits to be checked
+	// against the coded size of the SPS instead
+	tile := testTile(t)
+	tile.Width, tile.Height = 1, 1
+	hw := heif.NewWriter()
+	if _, err := hw.AddImage(tile); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if _, err := hw.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name string
+		b    []byte
+	}{
+		{"image", buf.Bytes()},
+		{"grid", writeGrid(t, 1, 1, tile)},
+	} {
+		for _, limits := range []Limits{{MaxPixels: 1 << 20}, {MaxTotalBytes: 1 << 20}} {
+			if _, err := DecodeWithOptions(bytes.NewReader(tt.b), &DecodeOptions{Limits: limits}); !errors.Is(err, ErrLimitExceeded) {
+				t.Errorf("%s: DecodeWithOptions with %+v = %v; want ErrLimitExceeded", tt.name, limits, err)
+			}
+		}
+	}
+}
+
+func TestDecodeContext(t *testing.T) {
+	b := writeGrid(t, 2, 2, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for _, opts := range []*DecodeOptions{nil, {Threads: 4}} {
+		if _, err := DecodeWithOptionsContext(ctx, bytes.NewReader(b), opts); err != context.Canceled {
+			t.Errorf("DecodeWithOptionsContext(%+v) with canceled context = %v; want %v", opts, err, context.Canceled)
+		}
+	}
+}
+
+func TestDecodeWritten(t *testing.T) {
+	b, err := ioutil.ReadFile("testdata/camel.heic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := Decode(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, h := want.Bounds().Dx(), want.Bounds().Dy()
+
+	// the image twice, side by side
+	got, err := Decode(bytes.NewReader(writeGrid(t, 1, 2, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Bounds() != image.Rect(0, 0, 2*w, h) {
+		t.Fatalf("decoded %v; want %dx%d", got.Bounds(), 2*w, h)
+	}
+	for _, x := range []int{0, w} {
+		for y := 0; y < h; y += 97 {
+			if got.At(x+y%w, y) != want.At(y%w, y) {
+				t.Fatalf("pixel %d,%d differs from the source image", x+y%w, y)
+			}
+		}
+	}
+}
+
+func TestDecodeCropped(t *testing.T) {
+	b, err := ioutil.ReadFile("testdata/camel.heic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := Decode(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		rect        image.Rectangle
+		orientation int
+		crop        image.Rectangle // rect on whole chroma samples
+	}{
+		{image.Rect(100, 50, 700, 451), 1, image.Rect(100, 50, 700, 451)},
+		{image.Rect(1, 1, 101, 61), 6, image.Rect(0, 0, 101, 61)},
+	} {
+		var buf bytes.Buffer
+		if _, err := heif.Open(bytes.NewReader(b)).Rewrite(&buf, heif.Crop(tt.rect), heif.SetOrientation(tt.orientation)); err != nil {
+			t.Fatal(err)
+		}
+
+		size := tt.crop.Size()
+		config, err := DecodeConfig(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if config.Width != size.X || config.Height != size.Y {
+			t.Errorf("%v: DecodeConfig = %dx%d; want %v", tt.rect, config.Width, config.Height, size)
+		}
+		got, err := Decode(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b0 := got.Bounds()
+		if b0.Size() != size {
+			t.Fatalf("%v: decoded %v; want %v", tt.rect, b0, size)
+		}
+		for y := 0; y < size.Y; y += 7 {
+			for x := 0; x < size.X; x += 13 {
+				if got.At(b0.Min.X+x, b0.Min.Y+y) != want.At(tt.crop.Min.X+x, tt.crop.Min.Y+y) {
+					t.Fatalf("%v: pixel %d,%d differs from the source image", tt.rect, x, y)
+				}
+			}
+		}
+
+		// cropped before it is rotated
+		img, err := DecodeWithOptions(bytes.NewReader(buf.Bytes()), &DecodeOptions{ApplyTransformations: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.orientation == 6 {
+			size = image.Pt(size.Y, size.X)
+		}
+		if got := img.Bounds().Size(); got != size {
+			t.Errorf("%v: transformed image of %v; want %v", tt.rect, got, size)
+		}
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	b, err := ioutil.ReadFile("testdata/camel.heic")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// keep the metadata but drop most of the coded data
+	_, err = Decode(bytes.NewReader(b[:len(b)/2]))
+	if !errors.Is(err, ErrCorrupt) {
+		t.Errorf("Decode of truncated file = %v; want ErrCorrupt", err)
+	}
+	var ie *heif.ItemError
+	if !errors.As(err, &ie) || ie.ItemID != 20002 {
+		t.Errorf("Decode of truncated file = %v; want an *heif.ItemError for item 20002", err)
+	}
+
+	_, err = DecodeWithOptions(bytes.NewReader(b), &DecodeOptions{VerifyHash: true, FastPreview: true})
+	if !errors.Is(err, ErrInvalidOptions) {
+		t.Errorf("Decode with VerifyHash and FastPreview = %v; want ErrInvalidOptions", err)
+	}
+}
+
+func TestCodecError(t *testing.T) {
+	for _, tt := range []struct {
+		code libde265.Code
+		want []error
+	}{
+		{libde265.CodePrematureEndOfSlice, []error{ErrCorrupt, ErrTruncated, ErrCodec}},
+		{libde265.CodeNotImplementedYet, []error{ErrUnsupported, ErrCodec}},
+		{libde265.CodeChecksumMismatch, []error{ErrChecksumMismatch, ErrCodec}},
+	} {
+		err := codecError(&libde265.Error{Op: "de265_decode", Code: tt.code})
+		for _, want := range tt.want {
+			if !errors.Is(err, want) {
+				t.Errorf("code %d: error does not wrap %v", tt.code, want)
+			}
+		}
+		var de *libde265.Error
+		if !errors.As(err, &de) || de.Code != tt.code {
+			t.Errorf("code %d: error does not wrap the *libde265.Error", tt.code)
+		}
+	}
+}
+
+func TestDecodeWithWarnings(t *testing.T) {
+	// a flipped byte in the middle of the slice data makes libde265
+	// warn about the end of a substream
+	tile := testTile(t)
+	tile.Data = append([]byte(nil), tile.Data...)
+	tile.Data[len(tile.Data)/2] ^= 0xff
+	b := writeGrid(t, 2, 2, tile)
+
+	var seen []Warning
+	opts := &DecodeOptions{Threads: 4, OnWarning: func(w Warning) { seen = append(seen, w) }}
+	img, warnings, err := DecodeWithWarnings(context.Background(), bytes.NewReader(b), opts)
+	if err != nil {
+		t.Fatalf("DecodeWithWarnings: %v", err)
+	}
+	if img == nil {
+		t.Fatalf("DecodeWithWarnings returned no image")
+	}
+	if len(warnings) == 0 {
+		t.Fatalf("DecodeWithWarnings returned no warnings")
+	}
+	if len(seen) != len(warnings) {
+		t.Errorf("OnWarning saw %d warnings; DecodeWithWarnings returned %d", len(seen), len(warnings))
+	}
+	for _, w := range warnings {
+		if w.ItemID == 0 || w.Text == "" {
+			t.Errorf("warning %+v lacks its item or text", w)
+		}
+	}
+}
+
+func TestTransformYCbCr(t *testing.T) {
+	src := image.NewYCbCr(image.Rect(0, 0, 4, 2), image.YCbCrSubsampleRatio422)
+	for i := range src.Y {
+		src.Y[i] = byte(i)
+	}
+
+	// 90 degrees counter-clockwise: the top right pixel ends up top left
+	out, err := transformYCbCr(src, rotateMapper(1), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := out.Rect, image.Rect(0, 0, 2, 4); got != want {
+		t.Fatalf("rotated bounds = %v; want %v", got, want)
+	}
+	if got, want := out.SubsampleRatio, image.YCbCrSubsampleRatio440; got != want {
+		t.Errorf("rotated subsample ratio = %v; want %v", got, want)
+	}
+	if got, want := out.Y[out.YOffset(0, 0)], src.Y[src.YOffset(3, 0)]; got != want {
+		t.Errorf("rotated top left = %d; want %d", got, want)
+	}
+
+	out, err = transformYCbCr(src, mirrorMapper(0), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := out.Y[out.YOffset(0, 1)], src.Y[src.YOffset(3, 1)]; got != want {
+		t.Errorf("mirrored pixel = %d; want %d", got, want)
+	}
+
+	// subimages whose chroma samples start before their first pixel
+	for _, ratio := range []image.YCbCrSubsampleRatio{image.YCbCrSubsampleRatio420, image.YCbCrSubsampleRatio422} {
+		src := image.NewYCbCr(image.Rect(0, 0, 9, 7), ratio)
+		for y := 0; y < 7; y++ {
+			for x := 0; x < 9; x++ {
+				src.Y[src.YOffset(x, y)] = byte(y*9 + x)
+				// the position of the chroma sample
+				src.Cb[src.COffset(x, y)] = byte(src.COffset(x, y) % src.CStride)
+				src.Cr[src.COffset(x, y)] = byte(src.COffset(x, y) / src.CStride)
+			}
+		}
+		for _, r := range []image.Rectangle{image.Rect(1, 1, 8, 6), image.Rect(1, 0, 9, 7), image.Rect(3, 3, 6, 4)} {
+			sub := src.SubImage(r).(*image.YCbCr)
+			w, h := r.Dx(), r.Dy()
+			for _, tt := range []struct {
+				name string
+				m    planeMapper
+				swap bool
+			}{
+				{"rotate 90", rotateMapper(1), true},
+				{"rotate 180", rotateMapper(2), false},
+				{"rotate 270", rotateMapper(3), true},
+				{"mirror", mirrorMapper(0), false},
+			} {
+				out, err := transformYCbCr(sub, tt.m, tt.swap)
+				if err != nil {
+					t.Fatalf("%v %v %s: %v", ratio, r, tt.name, err)
+				}
+				for y := 0; y < h; y++ {
+					for x := 0; x < w; x++ {
+						dx, dy := tt.m(x, y, w, h)
+						got, want := out.YCbCrAt(dx, dy), sub.YCbCrAt(r.Min.X+x, r.Min.Y+y)
+						if got.Y != want.Y {
+							t.Fatalf("%v %v %s: pixel %d,%d has luma %d; want %d", ratio, r, tt.name, x, y, got.Y, want.Y)
+						}
+						// the chroma is resampled by at most one sample
+						if diff(got.Cb, want.Cb) > 1 || diff(got.Cr, want.Cr) > 1 {
+							t.Fatalf("%v %v %s: pixel %d,%d has chroma %d,%d; want %d,%d", ratio, r, tt.name, x, y, got.Cb, got.Cr, want.Cb, want.Cr)
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
+func diff(a, b uint8) int {
+	if a > b {
+		return int(a - b)
+	}
+	return int(b - a)
+}
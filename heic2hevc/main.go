@@ -0,0 +1,64 @@
+// Command heic2hevc exports the coded images of a HEIF file as HEVC
+// streams in the format of Annex B, for use with other decoders and
+// tools such as ffmpeg. The tiles of a grid image are exported to one
+// file each.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/jdeng/goheif/heif"
+)
+
+func main() {
+	itemID := flag.Uint("item", 0, "ID of the item to export instead of the primary item")
+	flag.Parse()
+	if flag.NArg() != 2 {
+		fmt.Fprintf(os.Stderr, "usage: heic2hevc [-item id] <in-file> <out-prefix>\n")
+		os.Exit(1)
+	}
+
+	fin, prefix := flag.Arg(0), flag.Arg(1)
+	fi, err := os.Open(fin)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer fi.Close()
+
+	hf := heif.Open(fi)
+	var it *heif.Item
+	if *itemID != 0 {
+		it, err = hf.ItemByID(uint32(*itemID))
+	} else {
+		it, err = hf.PrimaryItem()
+	}
+	if err != nil {
+		log.Fatalf("Failed to parse %s: %v\n", fin, err)
+	}
+
+	if it.Info.ItemType != "grid" {
+		export(hf, it, prefix+".265")
+		return
+	}
+	tiles, err := hf.Tiles(it)
+	if err != nil {
+		log.Fatalf("Failed to parse %s: %v\n", fin, err)
+	}
+	for i, tile := range tiles {
+		export(hf, tile, fmt.Sprintf("%s-tile%03d.265", prefix, i))
+	}
+}
+
+func export(hf *heif.File, it *heif.Item, fout string) {
+	stream, err := hf.AnnexB(it)
+	if err != nil {
+		log.Fatalf("Failed to export item %d: %v\n", it.ID, err)
+	}
+	if err := os.WriteFile(fout, stream, 0644); err != nil {
+		log.Fatalf("Failed to write output file %s: %v\n", fout, err)
+	}
+	log.Printf("Export item %d to %s successfully\n", it.ID, fout)
+}
@@ -0,0 +1,72 @@
+package heif
+
+import (
+	"fmt"
+
+	"github.com/jdeng/goheif/hevc"
+)
+
+// AnnexB returns the coded image of an "hvc1" item as a byte stream in
+// the format of Annex B of the HEVC standard, as read by most decoders
+// and tools: the parameter sets of its hvcC property, followed by the
+// NAL units of its data, each preceded by a start code instead of its
+// length. The tiles of a grid item are exported one by one, see Tiles.
+// Errors are reported as an *ItemError.
+func (f *File) AnnexB(it *Item) ([]byte, error) {
+	fail := func(err error) ([]byte, error) {
+		return nil, &ItemError{ItemID: it.ID, Err: err}
+	}
+	if it.Info.ItemType != "hvc1" {
+		return fail(fmt.Errorf("%w: item type %q", ErrUnsupported, it.Info.ItemType))
+	}
+	hvcc, ok := it.HevcConfig()
+	if !ok {
+		return fail(fmt.Errorf("%w: no hvcC", ErrCorrupt))
+	}
+	data, err := f.GetItemData(it)
+	if err != nil {
+		return nil, err
+	}
+
+	var stream []byte
+	for _, na := range hvcc.NalArrays() {
+		stream = hevc.AppendAnnexB(stream, na.Units...)
+	}
+	size := hvcc.LengthSize()
+	for len(data) > 0 {
+		if len(data) < size {
+			return fail(fmt.Errorf("%w: NAL unit length of %d bytes", ErrCorrupt, len(data)))
+		}
+		var n uint64
+		for _, b := range data[:size] {
+			n = n<<8 | uint64(b)
+		}
+		if data = data[size:]; n > uint64(len(data)) {
+			return fail(fmt.Errorf("%w: NAL unit of %d bytes in %d", ErrCorrupt, n, len(data)))
+		}
+		stream = hevc.AppendAnnexB(stream, data[:n])
+		data = data[n:]
+	}
+	return stream, nil
+}
+
+// Tiles returns the tiles of a "grid" item, row by row.
+// Errors are reported as an *ItemError.
+func (f *File) Tiles(it *Item) ([]*Item, error) {
+	if it.Info.ItemType != "grid" {
+		return nil, &ItemError{ItemID: it.ID, Err: fmt.Errorf("%q item is not a grid", it.Info.ItemType)}
+	}
+	dimg := it.Reference("dimg")
+	if dimg == nil {
+		return nil, &ItemError{ItemID: it.ID, Err: fmt.Errorf("%w: no dimg", ErrCorrupt)}
+	}
+	tiles := make([]*Item, len(dimg.ToItemIDs))
+	for i, id := range dimg.ToItemIDs {
+		tile, err := f.ItemByID(id)
+		if err != nil {
+			return nil, err
+		}
+		tiles[i] = tile
+	}
+	return tiles, nil
+}
@@ -0,0 +1,65 @@
+package heif
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+func TestAnnexB(t *testing.T) {
+	f, err := os.Open("../testdata/camel.heic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	src := Open(f)
+	primary, err := src.PrimaryItem()
+	if err != nil {
+		t.Fatal(err)
+	}
+	img := testImage(t, src, primary)
+
+	stream, err := src.AnnexB(primary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ImageFromAnnexB(stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.Data, img.Data) || !bytes.Equal(got.Config.AsHeader(), img.Config.AsHeader()) {
+		t.Errorf("AnnexB stream does not read back as the item")
+	}
+
+	w := NewWriter()
+	if _, err := w.AddGrid(&Grid{Rows: 2, Columns: 1, Width: img.Width, Height: 2 * img.Height, Tiles: []*Image{img, img}}); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if _, err := w.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	hf := Open(bytes.NewReader(buf.Bytes()))
+	grid, err := hf.PrimaryItem()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := hf.AnnexB(grid); err == nil {
+		t.Errorf("AnnexB of a grid item succeeded")
+	}
+	tiles, err := hf.Tiles(grid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tiles) != 2 {
+		t.Fatalf("%d tiles; want 2", len(tiles))
+	}
+	for _, tile := range tiles {
+		if got, err := hf.AnnexB(tile); err != nil || !bytes.Equal(got, stream) {
+			t.Errorf("AnnexB of tile %d: %d bytes, %v; want the %d bytes of the image", tile.ID, len(got), err, len(stream))
+		}
+	}
+	if _, err := hf.Tiles(tiles[0]); err == nil {
+		t.Errorf("Tiles of an hvc1 item succeeded")
+	}
+}
@@ -31,11 +31,15 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"image"
 	"io"
 	"io/ioutil"
+	"math"
 	"strings"
 )
 
+// NewReader returns a Reader of the boxes in r. Box offsets are
+// reported relative to the first byte read from r.
 func NewReader(r io.Reader) *Reader {
 	br, ok := r.(*bufio.Reader)
 	if !ok {
@@ -44,10 +48,88 @@ func NewReader(r io.Reader) *Reader {
 	return &Reader{br: bufReader{Reader: br}}
 }
 
+// NewReaderAt returns a Reader of the boxes in r, starting at offset 0.
+// Unlike with NewReader, the children of parsed boxes are not read into
+// memory but read from r when they are parsed in turn, and skipped boxes
+// are not read at all.
+func NewReaderAt(r io.ReaderAt) *Reader {
+	src := &readerAtReader{ra: r}
+	return &Reader{br: bufReader{Reader: bufio.NewReader(src), ra: r}, src: src}
+}
+
 type Reader struct {
 	br          bufReader
-	lastBox     Box  // or nil
-	noMoreBoxes bool // a box with size 0 (the final box) was seen
+	lastBox     *box  // or nil
+	noMoreBoxes bool  // a box with size 0 (the final box) was seen
+	pos         int64 // offset of the next box, or -1 if unknown
+
+	src *readerAtReader // with NewReaderAt
+}
+
+// readerAtReader reads an io.ReaderAt sequentially.
+type readerAtReader struct {
+	ra  io.ReaderAt
+	off int64
+}
+
+func (r *readerAtReader) Read(p []byte) (int, error) {
+	n, err := r.ra.ReadAt(p, r.off)
+	r.off += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// Limits bounds the work done while reading boxes from untrusted input.
+// A zero field means no limit.
+type Limits struct {
+	MaxBoxes int // total number of boxes read, including nested ones
+
+	// MaxMetadataBytes bounds the box data held in memory: the bodies
+	// of boxes read with NewReader, the data of idat boxes, the
+	// parameter sets of hvcC boxes and data read by registered parsers.
+	MaxMetadataBytes int64
+}
+
+// ErrLimitExceeded is returned when reading boxes would exceed a Limits field.
+var ErrLimitExceeded = errors.New("heif: limit exceeded")
+
+// budget tracks the usage of Limits. It is shared by a Reader and
+// every box read from it, including nested ones.
+type budget struct {
+	limits Limits
+	boxes  int
+	bytes  int64
+}
+
+func (b *budget) addBox() error {
+	if b == nil {
+		return nil
+	}
+	b.boxes++
+	if max := b.limits.MaxBoxes; max > 0 && b.boxes > max {
+		return fmt.Errorf("more than %d boxes: %w", max, ErrLimitExceeded)
+	}
+	return nil
+}
+
+// addBytes charges n bytes about to be held in memory.
+func (b *budget) addBytes(n int64) error {
+	if b == nil {
+		return nil
+	}
+	b.bytes += n
+	if max := b.limits.MaxMetadataBytes; max > 0 && b.bytes > max {
+		return fmt.Errorf("more than %d bytes of metadata: %w", max, ErrLimitExceeded)
+	}
+	return nil
+}
+
+// SetLimits sets the limits for boxes read from r from now on,
+// including the children of those boxes.
+func (r *Reader) SetLimits(l Limits) {
+	r.br.budget = &budget{limits: l}
 }
 
 type BoxType [4]byte
@@ -56,6 +138,17 @@ type BoxType [4]byte
 var (
 	TypeFtyp = BoxType{'f', 't', 'y', 'p'}
 	TypeMeta = BoxType{'m', 'e', 't', 'a'}
+	TypeMdat = BoxType{'m', 'd', 'a', 't'}
+	TypeHdlr = BoxType{'h', 'd', 'l', 'r'}
+	TypeDref = BoxType{'d', 'r', 'e', 'f'}
+	TypePitm = BoxType{'p', 'i', 't', 'm'}
+	TypeIinf = BoxType{'i', 'i', 'n', 'f'}
+	TypeInfe = BoxType{'i', 'n', 'f', 'e'}
+	TypeIloc = BoxType{'i', 'l', 'o', 'c'}
+	TypeIdat = BoxType{'i', 'd', 'a', 't'}
+	TypeIref = BoxType{'i', 'r', 'e', 'f'}
+	TypeIpma = BoxType{'i', 'p', 'm', 'a'}
+	TypeIspe = BoxType{'i', 's', 'p', 'e'}
 )
 
 func (t BoxType) String() string { return string(t[:]) }
@@ -89,9 +182,67 @@ type Box interface {
 	Body() io.Reader
 }
 
+// OffsetBox is implemented by the boxes read by this package, which
+// know where they were read from.
+type OffsetBox interface {
+	Box
+
+	// Offset returns the position of the box header, relative to the
+	// start of the outermost Reader, or -1 if it is not known.
+	Offset() int64
+}
+
 // ErrUnknownBox is returned by Box.Parse for unrecognized box types.
 var ErrUnknownBox = errors.New("heif: unknown box")
 
+// ErrCorrupt is wrapped by the errors for boxes that are truncated or
+// otherwise malformed.
+var ErrCorrupt = errors.New("heif: corrupt container")
+
+// ErrUnsupported is wrapped by the errors for well-formed boxes using
+// features that this package does not implement.
+var ErrUnsupported = errors.New("heif: unsupported feature")
+
+// BoxError records an error and the box it occurred in. Err wraps one of
+// ErrCorrupt, ErrUnsupported or ErrLimitExceeded, except for the errors
+// of Marshal for fields that cannot be encoded.
+type BoxError struct {
+	Type   BoxType
+	Offset int64 // of the box header, or -1 if unknown
+	Err    error
+}
+
+func (e *BoxError) Error() string {
+	if e.Offset < 0 {
+		return fmt.Sprintf("bmff: %q box: %v", e.Type, e.Err)
+	}
+	return fmt.Sprintf("bmff: %q box at offset %d: %v", e.Type, e.Offset, e.Err)
+}
+
+func (e *BoxError) Unwrap() error { return e.Err }
+
+// corrupt classifies err as ErrCorrupt unless it already wraps one of
+// the sentinel errors of this package.
+func corrupt(err error) error {
+	if errors.Is(err, ErrCorrupt) || errors.Is(err, ErrUnsupported) || errors.Is(err, ErrLimitExceeded) {
+		return err
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return fmt.Errorf("%w: %v", ErrCorrupt, err)
+}
+
+// boxError wraps err in a BoxError for b, unless err already carries
+// one from a nested box.
+func (b *box) boxError(err error) error {
+	var be *BoxError
+	if errors.As(err, &be) {
+		return err
+	}
+	return &BoxError{Type: b.boxType, Offset: b.offset, Err: corrupt(err)}
+}
+
 type parserFunc func(b *box, br *bufReader) (Box, error)
 
 func boxType(s string) BoxType {
@@ -114,6 +265,7 @@ var parsers = map[BoxType]parserFunc{
 	boxType("iprp"): parseItemPropertiesBox,
 	boxType("irot"): parseImageRotation,
 	boxType("imir"): parseImageMirror,
+	boxType("clap"): parseCleanAperture,
 	boxType("ispe"): parseImageSpatialExtentsProperty,
 	boxType("meta"): parseMetaBox,
 	boxType("pitm"): parsePrimaryItemBox,
@@ -125,18 +277,44 @@ var parsers = map[BoxType]parserFunc{
 type box struct {
 	size    int64 // 0 means unknown, will read to end of file (box container)
 	boxType BoxType
+	offset  int64 // of the header, or -1 if unknown
+	hdrSize int64
 	body    io.Reader
-	parsed  Box    // if non-nil, the Parsed result
-	slurp   []byte // if non-nil, the contents slurped to memory
+	parsed  Box     // if non-nil, the Parsed result
+	slurp   []byte  // if non-nil, the contents slurped to memory
+	budget  *budget // shared with the Reader the box was read from
+	toEnd   bool    // the header has size 0
+
+	ra   io.ReaderAt // the source of the box, if read with NewReaderAt
+	lazy bool        // Body reads from ra
 }
 
+func (b *box) base() *box    { return b }
 func (b *box) Size() int64   { return b.size }
 func (b *box) Type() BoxType { return b.boxType }
+func (b *box) Offset() int64 { return b.offset }
+
+// bodyOffset returns the offset of the box body, or -1 if unknown.
+func (b *box) bodyOffset() int64 {
+	if b.offset < 0 {
+		return -1
+	}
+	return b.offset + b.hdrSize
+}
+
+// newBufReader returns a bufReader of the box body.
+func (b *box) newBufReader() *bufReader {
+	cr := &countingReader{r: b.Body()}
+	return &bufReader{Reader: bufio.NewReader(cr), budget: b.budget, cr: cr, base: b.bodyOffset(), ra: b.ra}
+}
 
 func (b *box) Body() io.Reader {
 	if b.slurp != nil {
 		return bytes.NewReader(b.slurp)
 	}
+	if b.lazy {
+		return io.NewSectionReader(b.ra, b.bodyOffset(), b.size-b.hdrSize)
+	}
 	return b.body
 }
 
@@ -144,13 +322,16 @@ func (b *box) Parse() (Box, error) {
 	if b.parsed != nil {
 		return b.parsed, nil
 	}
-	parser, ok := parsers[b.Type()]
+	parser, ok := parserFor(b.Type())
 	if !ok {
 		return nil, ErrUnknownBox
 	}
-	v, err := parser(b, &bufReader{Reader: bufio.NewReader(b.Body())})
+	v, err := parser(b, b.newBufReader())
+	if err == ErrUnknownBox {
+		return nil, err // a "uuid" box of an unregistered user type
+	}
 	if err != nil {
-		return nil, err
+		return nil, b.boxError(err)
 	}
 	b.parsed = v
 	return v, nil
@@ -173,7 +354,7 @@ func (r *Reader) ReadBox() (Box, error) {
 		return nil, io.EOF
 	}
 	if r.lastBox != nil {
-		if _, err := io.Copy(ioutil.Discard, r.lastBox.Body()); err != nil {
+		if err := r.skip(r.lastBox); err != nil {
 			return nil, err
 		}
 	}
@@ -181,15 +362,25 @@ func (r *Reader) ReadBox() (Box, error) {
 
 	_, err := io.ReadFull(r.br, buf[:4])
 	if err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = &BoxError{Offset: r.pos, Err: corrupt(err)}
+		}
 		return nil, err
 	}
 	box := &box{
-		size: int64(binary.BigEndian.Uint32(buf[:4])),
+		size:    int64(binary.BigEndian.Uint32(buf[:4])),
+		offset:  r.pos,
+		hdrSize: 8,
+		budget:  r.br.budget,
+		ra:      r.br.ra,
 	}
 
 	_, err = io.ReadFull(r.br, box.boxType[:]) // 4 more bytes
 	if err != nil {
-		return nil, err
+		return nil, box.boxError(err)
+	}
+	if err := r.br.budget.addBox(); err != nil {
+		return nil, box.boxError(err)
 	}
 
 	// Special cases for size:
@@ -199,47 +390,74 @@ func (r *Reader) ReadBox() (Box, error) {
 		// 1 means it's actually a 64-bit size, after the type.
 		_, err = io.ReadFull(r.br, buf[:8])
 		if err != nil {
-			return nil, err
+			return nil, box.boxError(err)
 		}
+		box.hdrSize += 8
 		box.size = int64(binary.BigEndian.Uint64(buf[:8]))
 		if box.size < 0 {
 			// Go uses int64 for sizes typically, but BMFF uses uint64.
 			// We assume for now that nobody actually uses boxes larger
 			// than int64.
-			return nil, fmt.Errorf("unexpectedly large box %q", box.boxType)
+			return nil, box.boxError(fmt.Errorf("%w: unexpectedly large box %q", ErrUnsupported, box.boxType))
 		}
 		remain = box.size - 2*4 - 8
 	case 0:
 		// 0 means unknown & to read to end of file. No more boxes.
 		r.noMoreBoxes = true
+		box.toEnd = true
 	default:
 		remain = box.size - 2*4
 	}
 	if remain < 0 {
-		return nil, fmt.Errorf("Box header for %q has size %d, suggesting %d (negative) bytes remain", box.boxType, box.size, remain)
+		return nil, box.boxError(fmt.Errorf("Box header for %q has size %d, suggesting %d (negative) bytes remain", box.boxType, box.size, remain))
 	}
 	if box.size > 0 {
 		box.body = io.LimitReader(r.br, remain)
+		// with NewReaderAt, Body reads from the start every time
+		box.lazy = r.src != nil && box.offset >= 0
+		if r.pos >= 0 {
+			r.pos += box.size
+		}
 	} else {
 		box.body = r.br
+		r.pos = -1
 	}
 	r.lastBox = box
 	return box, nil
 }
 
+// skip consumes the unread rest of b. Without NewReaderAt, that means
+// reading it.
+func (r *Reader) skip(b *box) error {
+	lr, ok := b.body.(*io.LimitedReader)
+	if r.src == nil || !ok {
+		_, err := io.Copy(ioutil.Discard, b.body)
+		return err
+	}
+	buffered := int64(r.br.Buffered())
+	if lr.N <= buffered {
+		_, err := io.CopyN(ioutil.Discard, lr, lr.N)
+		return err
+	}
+	r.br.Discard(int(buffered))
+	r.src.off += lr.N - buffered
+	lr.N = 0
+	return nil
+}
+
 // ReadAndParseBox wraps the ReadBox method, ensuring that the read box is of type typ
 // and parses successfully. It returns the parsed box.
 func (r *Reader) ReadAndParseBox(typ BoxType) (Box, error) {
 	box, err := r.ReadBox()
 	if err != nil {
-		return nil, fmt.Errorf("error reading %q box: %v", typ, err)
+		return nil, fmt.Errorf("error reading %q box: %w", typ, err)
 	}
 	if box.Type() != typ {
-		return nil, fmt.Errorf("error reading %q box: got box type %q instead", typ, box.Type())
+		return nil, fmt.Errorf("error reading %q box: got box type %q instead: %w", typ, box.Type(), ErrCorrupt)
 	}
 	pbox, err := box.Parse()
 	if err != nil {
-		return nil, fmt.Errorf("error parsing read %q box: %v", typ, err)
+		return nil, fmt.Errorf("error parsing read %q box: %w", typ, err)
 	}
 	return pbox, nil
 }
@@ -249,7 +467,7 @@ func readFullBox(outer *box, br *bufReader) (fb FullBox, err error) {
 	// Parse FullBox header.
 	buf, err := br.Peek(4)
 	if err != nil {
-		return FullBox{}, fmt.Errorf("failed to read 4 bytes of FullBox: %v", err)
+		return FullBox{}, fmt.Errorf("failed to read 4 bytes of FullBox: %w", err)
 	}
 	fb.Version = buf[0]
 	buf[0] = 0
@@ -308,6 +526,9 @@ func (br *bufReader) parseAppendBoxes(dst *[]Box) error {
 		return br.err
 	}
 	boxr := NewReader(br.Reader)
+	boxr.br.budget = br.budget
+	boxr.br.ra = br.ra
+	boxr.pos = br.offset()
 	for {
 		inner, err := boxr.ReadBox()
 		if err == io.EOF {
@@ -317,12 +538,28 @@ func (br *bufReader) parseAppendBoxes(dst *[]Box) error {
 			br.err = err
 			return err
 		}
-		slurp, err := ioutil.ReadAll(inner.Body())
+		ib := inner.(*box)
+		if ib.ra != nil && ib.offset >= 0 && ib.size > 0 {
+			// read again from ra once parsed, see Body
+			ib.lazy = true
+			*dst = append(*dst, inner)
+			continue
+		}
+		if ib.size > 0 {
+			err = br.budget.addBytes(ib.size - ib.hdrSize)
+		}
+		var slurp []byte
+		if err == nil {
+			slurp, err = ioutil.ReadAll(ib.body)
+		}
+		if err == nil && ib.size == 0 {
+			err = br.budget.addBytes(int64(len(slurp)))
+		}
 		if err != nil {
-			br.err = err
-			return err
+			br.err = ib.boxError(err)
+			return br.err
 		}
-		inner.(*box).slurp = slurp
+		ib.slurp = slurp
 		*dst = append(*dst, inner)
 	}
 }
@@ -354,7 +591,7 @@ func parseItemInfoEntry(outer *box, br *bufReader) (Box, error) {
 	}
 	ie := &ItemInfoEntry{FullBox: fb}
 	if fb.Version != 2 {
-		return nil, fmt.Errorf("TODO: found version %d infe box. Only 2 is supported now.", fb.Version)
+		return nil, fmt.Errorf("%w: found version %d infe box. Only 2 is supported now.", ErrUnsupported, fb.Version)
 	}
 
 	ie.ItemID, _ = br.readUint16()
@@ -367,6 +604,7 @@ func parseItemInfoEntry(outer *box, br *bufReader) (Box, error) {
 		return nil, err
 	}
 	ie.ItemType = string(buf[:4])
+	br.Discard(4)
 	ie.Name, _ = br.readString()
 
 	switch ie.ItemType {
@@ -398,7 +636,7 @@ func parseItemInfoBox(outer *box, br *bufReader) (Box, error) {
 	}
 	ib := &ItemInfoBox{FullBox: fb}
 
-	if ib.Version > 1 {
+	if ib.Version > 0 {
 		ib.Count, _ = br.readUint32()
 	} else {
 		count, _ := br.readUint16()
@@ -411,7 +649,7 @@ func parseItemInfoBox(outer *box, br *bufReader) (Box, error) {
 		for _, box := range itemInfos {
 			pb, err := box.Parse()
 			if err != nil {
-				return nil, fmt.Errorf("error parsing ItemInfoEntry in ItemInfoBox: %v", err)
+				return nil, fmt.Errorf("error parsing ItemInfoEntry in ItemInfoBox: %w", err)
 			}
 			if iie, ok := pb.(*ItemInfoEntry); ok {
 				ib.ItemInfos = append(ib.ItemInfos, iie)
@@ -449,9 +687,9 @@ func parseItemReferenceBox(outer *box, br *bufReader) (Box, error) {
 
 	if br.ok() {
 		for _, b := range itemRefs {
-			pb, err := parseItemReferenceEntry(b.(*box), &bufReader{Reader: bufio.NewReader(b.Body())}, ib.Version)
+			pb, err := parseItemReferenceEntry(b.(*box), b.(*box).newBufReader(), ib.Version)
 			if err != nil {
-				return nil, fmt.Errorf("error parsing ItemReferenceEntry in ItemReferenceBox: %v", err)
+				return nil, fmt.Errorf("error parsing ItemReferenceEntry in ItemReferenceBox: %w", err)
 			}
 			if iie, ok := pb.(*ItemReferenceEntry); ok {
 				ib.ItemRefs = append(ib.ItemRefs, iie)
@@ -490,7 +728,33 @@ func parseItemReferenceEntry(outer *box, br *bufReader, version uint8) (Box, err
 // bufReader adds some HEIF/BMFF-specific methods around a *bufio.Reader.
 type bufReader struct {
 	*bufio.Reader
-	err error // sticky error
+	err    error       // sticky error
+	budget *budget     // or nil
+	ra     io.ReaderAt // with NewReaderAt, for reading nested boxes lazily
+
+	// For tracking the offset of nested boxes:
+	cr   *countingReader // source of Reader, or nil
+	base int64           // offset of the first byte of cr, or -1 if unknown
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// offset returns the offset of the next unread byte, or -1 if unknown.
+func (br *bufReader) offset() int64 {
+	if br.cr == nil || br.base < 0 {
+		return -1
+	}
+	return br.base + br.cr.n - int64(br.Buffered())
 }
 
 // ok reports whether all previous reads have been error-free.
@@ -625,7 +889,7 @@ func parseItemPropertiesBox(outer *box, br *bufReader) (Box, error) {
 
 	cb, err := boxes[0].Parse()
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse first box, %q: %v", boxes[0].Type(), err)
+		return nil, fmt.Errorf("failed to parse first box, %q: %w", boxes[0].Type(), err)
 	}
 
 	var ok bool
@@ -639,7 +903,7 @@ func parseItemPropertiesBox(outer *box, br *bufReader) (Box, error) {
 	for _, box := range boxes[1:] {
 		boxp, err := box.Parse()
 		if err != nil {
-			return nil, fmt.Errorf("failed to parse association box: %v", err)
+			return nil, fmt.Errorf("failed to parse association box: %w", err)
 		}
 		ipa, ok := boxp.(*ItemPropertyAssociation)
 		if !ok {
@@ -744,6 +1008,7 @@ func parseImageSpatialExtentsProperty(outer *box, br *bufReader) (Box, error) {
 
 type OffsetLength struct {
 	Offset, Length uint64
+	Index          uint64 // extent_index, only in version 1 and 2 boxes
 }
 
 // not a box
@@ -774,7 +1039,7 @@ func parseItemLocationBox(outer *box, br *bufReader) (Box, error) {
 	ilb := &ItemLocationBox{
 		FullBox: fb,
 	}
-	buf, err := br.Peek(4)
+	buf, err := br.Peek(2)
 	if err != nil {
 		return nil, err
 	}
@@ -784,13 +1049,25 @@ func parseItemLocationBox(outer *box, br *bufReader) (Box, error) {
 	if fb.Version > 0 { // version 1
 		ilb.indexSize = buf[1] & 15
 	}
+	br.Discard(2)
 
-	ilb.ItemCount = binary.BigEndian.Uint16(buf[2:4])
-	br.Discard(4)
+	// version 2 has 32-bit item IDs
+	readID := func() uint16 {
+		if fb.Version < 2 {
+			v, _ := br.readUint16()
+			return v
+		}
+		v, _ := br.readUint32()
+		if v > 0xFFFF && br.ok() {
+			br.err = fmt.Errorf("%w: item ID %d", ErrUnsupported, v)
+		}
+		return uint16(v)
+	}
+	ilb.ItemCount = readID()
 
 	for i := 0; br.ok() && i < int(ilb.ItemCount); i++ {
 		var ent ItemLocationBoxEntry
-		ent.ItemID, _ = br.readUint16()
+		ent.ItemID = readID()
 		if fb.Version > 0 { // version 1
 			cmeth, _ := br.readUint16()
 			ent.ConstructionMethod = byte(cmeth & 15)
@@ -811,6 +1088,9 @@ func parseItemLocationBox(outer *box, br *bufReader) (Box, error) {
 		ent.ExtentCount, _ = br.readUint16()
 		for j := 0; br.ok() && j < int(ent.ExtentCount); j++ {
 			var ol OffsetLength
+			if fb.Version > 0 {
+				ol.Index, _ = br.readUintN(ilb.indexSize * 8)
+			}
 			ol.Offset, _ = br.readUintN(ilb.offsetSize * 8)
 			ol.Length, _ = br.readUintN(ilb.lengthSize * 8)
 			if br.err != nil {
@@ -831,6 +1111,8 @@ type HandlerBox struct {
 	FullBox
 	HandlerType string // always 4 bytes; usually "pict" for iOS Camera images
 	Name        string
+
+	trailer []byte // after Name, such as extra null bytes; kept by Marshal
 }
 
 func parseHandlerBox(gen *box, br *bufReader) (Box, error) {
@@ -849,6 +1131,9 @@ func parseHandlerBox(gen *box, br *bufReader) (Box, error) {
 	br.Discard(20)
 
 	hb.Name, _ = br.readString()
+	if br.ok() {
+		hb.trailer, br.err = io.ReadAll(io.LimitReader(br, 256))
+	}
 	return hb, br.err
 }
 
@@ -892,7 +1177,15 @@ func parsePrimaryItemBox(gen *box, br *bufReader) (Box, error) {
 		return nil, err
 	}
 	pib := &PrimaryItemBox{FullBox: fb}
-	pib.ItemID, _ = br.readUint16()
+	if fb.Version == 0 {
+		pib.ItemID, _ = br.readUint16()
+	} else {
+		id, _ := br.readUint32()
+		if id > 0xFFFF {
+			return nil, fmt.Errorf("%w: item ID %d", ErrUnsupported, id)
+		}
+		pib.ItemID = uint16(id)
+	}
 	if !br.ok() {
 		return nil, br.err
 	}
@@ -910,6 +1203,11 @@ func parseItemDataBox(gen *box, br *bufReader) (Box, error) {
 		return nil, err
 	}
 
+	if gen.size > 0 {
+		if err := gen.budget.addBytes(gen.size - gen.hdrSize); err != nil {
+			return nil, err
+		}
+	}
 	data, err := ioutil.ReadAll(fb.Body())
 	if err != nil {
 		return nil, err
@@ -956,44 +1254,125 @@ func parseImageMirror(gen *box, br *bufReader) (Box, error) {
 	return &ImageMirror{box: gen, Mirror: v & 1}, nil
 }
 
-// ItemHevcConfigBox is a HEIF "hvcC" property
-type hevcConfig struct {
-	version                          uint8
-	generalProfileSpace              uint8
-	generalTierFlag                  uint8
-	generalProfileIdc                uint8
-	generalProfileCompatibilityFlags uint32
+// CleanAperture is a HEIF "clap" property, cropping an image. The size
+// and the offset of the center of the crop from that of the image are
+// fractions of a numerator N and a denominator D.
+type CleanAperture struct {
+	*box
+	WidthN, WidthD   uint32
+	HeightN, HeightD uint32
+	HorizOffN        int32
+	HorizOffD        uint32
+	VertOffN         int32
+	VertOffD         uint32
+}
+
+func parseCleanAperture(gen *box, br *bufReader) (Box, error) {
+	var v [8]uint32
+	for i := range v {
+		var err error
+		if v[i], err = br.readUint32(); err != nil {
+			return nil, err
+		}
+	}
+	return &CleanAperture{
+		box:    gen,
+		WidthN: v[0], WidthD: v[1],
+		HeightN: v[2], HeightD: v[3],
+		HorizOffN: int32(v[4]), HorizOffD: v[5],
+		VertOffN: int32(v[6]), VertOffD: v[7],
+	}, nil
+}
 
-	generalLevelIdc uint8
+// Rect returns the crop of an image of the given size, rounded to whole
+// pixels. It reports false if a denominator is zero or the crop is empty
+// or not within the image.
+func (c *CleanAperture) Rect(width, height int) (image.Rectangle, bool) {
+	if c.WidthD == 0 || c.HeightD == 0 || c.HorizOffD == 0 || c.VertOffD == 0 {
+		return image.Rectangle{}, false
+	}
+	w := math.Round(float64(c.WidthN) / float64(c.WidthD))
+	h := math.Round(float64(c.HeightN) / float64(c.HeightD))
+	x := math.Round(float64(c.HorizOffN)/float64(c.HorizOffD) + (float64(width)-w)/2)
+	y := math.Round(float64(c.VertOffN)/float64(c.VertOffD) + (float64(height)-h)/2)
+	r := image.Rect(int(x), int(y), int(x+w), int(y+h))
+	if r.Empty() || !r.In(image.Rect(0, 0, width, height)) {
+		return image.Rectangle{}, false
+	}
+	return r, true
+}
+
+// HevcConfig is the HEVCDecoderConfigurationRecord of an hvcC box, with
+// reserved bits dropped and bit depths stored as such rather than minus 8.
+type HevcConfig struct {
+	Version                          uint8
+	GeneralProfileSpace              uint8
+	GeneralTierFlag                  uint8
+	GeneralProfileIdc                uint8
+	GeneralProfileCompatibilityFlags uint32
+	GeneralConstraintIndicatorFlags  uint64 // 48 bits
+
+	GeneralLevelIdc uint8
 
-	minSpatialSegmentationIdc uint16
-	parallelismType           uint8
-	chromaFormat              uint8
-	bitDepthLuma              uint8
-	bitDepthChroma            uint8
-	avgFrameRate              uint16
+	MinSpatialSegmentationIdc uint16
+	ParallelismType           uint8
+	ChromaFormat              uint8 // chroma_format_idc, 1 for 4:2:0
+	BitDepthLuma              uint8
+	BitDepthChroma            uint8
+	AvgFrameRate              uint16
 
-	constantFrameRate uint8
-	numTemporalLayers uint8
-	temporalIdNested  uint8
+	ConstantFrameRate  uint8
+	NumTemporalLayers  uint8
+	TemporalIdNested   uint8
+	LengthSizeMinusOne uint8 // of the NAL units in the item data
 }
 
-type hevcNalArray struct {
-	completeness uint8
-	unitType     uint8
-	units        [][]byte
+// HevcNalArray holds the parameter sets of one NAL unit type.
+type HevcNalArray struct {
+	Completeness uint8
+	UnitType     uint8
+	Units        [][]byte // without length prefix
 }
 
+// ItemHevcConfigBox is a HEIF "hvcC" property
 type ItemHevcConfigBox struct {
 	*box
-	config   hevcConfig
-	nalArray []*hevcNalArray
+	config   HevcConfig
+	nalArray []*HevcNalArray
+}
+
+// Config returns the decoder configuration.
+func (ib *ItemHevcConfigBox) Config() HevcConfig {
+	return ib.config
+}
+
+// NalArrays returns the parameter sets, grouped by NAL unit type.
+func (ib *ItemHevcConfigBox) NalArrays() []*HevcNalArray {
+	return ib.nalArray
+}
+
+// NalUnits returns the parameter sets of the given NAL unit type, e.g.
+// 33 for the SPS.
+func (ib *ItemHevcConfigBox) NalUnits(unitType uint8) [][]byte {
+	var units [][]byte
+	for _, na := range ib.nalArray {
+		if na.UnitType == unitType {
+			units = append(units, na.Units...)
+		}
+	}
+	return units
+}
+
+// LengthSize returns the size in bytes of the length preceding each NAL
+// unit of the item data.
+func (ib *ItemHevcConfigBox) LengthSize() int {
+	return int(ib.config.LengthSizeMinusOne) + 1
 }
 
 func (ib *ItemHevcConfigBox) AsHeader() []byte {
 	var out []byte
 	for _, na := range ib.nalArray {
-		for _, unit := range na.units {
+		for _, unit := range na.Units {
 			n := len(unit)
 			out = append(out, byte((n>>24)&0xff))
 			out = append(out, byte((n>>16)&0xff))
@@ -1010,32 +1389,38 @@ func parseItemHevcConfigBox(gen *box, br *bufReader) (Box, error) {
 	ib := &ItemHevcConfigBox{box: gen}
 
 	c := &ib.config
-	c.version, _ = br.readUint8()
+	c.Version, _ = br.readUint8()
 
 	ch, _ := br.readUint8()
-	c.generalProfileSpace = uint8((ch >> 6) & 3)
-	c.generalTierFlag = uint8((ch >> 5) & 1)
-	c.generalProfileIdc = uint8(ch & 0x1F)
+	c.GeneralProfileSpace = uint8((ch >> 6) & 3)
+	c.GeneralTierFlag = uint8((ch >> 5) & 1)
+	c.GeneralProfileIdc = uint8(ch & 0x1F)
 
-	c.generalProfileCompatibilityFlags, _ = br.readUint32()
+	c.GeneralProfileCompatibilityFlags, _ = br.readUint32()
 
 	for i := 0; i < 6; i += 1 {
-		//TODO: general_constraint_indicator_flags
 		ch, _ = br.readUint8()
+		c.GeneralConstraintIndicatorFlags = c.GeneralConstraintIndicatorFlags<<8 | uint64(ch)
 	}
 
-	c.generalLevelIdc, _ = br.readUint8()
-	c.minSpatialSegmentationIdc, _ = br.readUint16()
-	c.parallelismType, _ = br.readUint8()
-	c.chromaFormat, _ = br.readUint8()
-	c.bitDepthLuma, _ = br.readUint8()
-	c.bitDepthChroma, _ = br.readUint8()
-	c.avgFrameRate, _ = br.readUint16()
+	c.GeneralLevelIdc, _ = br.readUint8()
+	c.MinSpatialSegmentationIdc, _ = br.readUint16()
+	c.MinSpatialSegmentationIdc &= 0x0FFF
+	ch, _ = br.readUint8()
+	c.ParallelismType = ch & 0x03
+	ch, _ = br.readUint8()
+	c.ChromaFormat = ch & 0x03
+	ch, _ = br.readUint8()
+	c.BitDepthLuma = ch&0x07 + 8
+	ch, _ = br.readUint8()
+	c.BitDepthChroma = ch&0x07 + 8
+	c.AvgFrameRate, _ = br.readUint16()
 
 	ch, _ = br.readUint8()
-	c.constantFrameRate = uint8((ch >> 6) & 0x03)
-	c.numTemporalLayers = uint8((ch >> 3) & 0x07)
-	c.temporalIdNested = uint8((ch >> 2) & 1)
+	c.ConstantFrameRate = uint8((ch >> 6) & 0x03)
+	c.NumTemporalLayers = uint8((ch >> 3) & 0x07)
+	c.TemporalIdNested = uint8((ch >> 2) & 1)
+	c.LengthSizeMinusOne = uint8(ch & 0x03)
 
 	numArrays, err := br.readUint8()
 	if err != nil {
@@ -1045,9 +1430,9 @@ func parseItemHevcConfigBox(gen *box, br *bufReader) (Box, error) {
 	for i := 0; i < int(numArrays); i += 1 {
 		ch, _ := br.readUint8()
 
-		na := &hevcNalArray{}
-		na.completeness = uint8((ch >> 6) & 1)
-		na.unitType = uint8(ch & 0x3F)
+		na := &HevcNalArray{}
+		na.Completeness = uint8((ch >> 7) & 1)
+		na.UnitType = uint8(ch & 0x3F)
 
 		numUnits, _ := br.readUint16()
 		for j := 0; j < int(numUnits); j += 1 {
@@ -1056,11 +1441,14 @@ func parseItemHevcConfigBox(gen *box, br *bufReader) (Box, error) {
 				continue
 			}
 
+			if err := gen.budget.addBytes(int64(size)); err != nil {
+				return nil, err
+			}
 			unit := make([]byte, size)
 			if _, err := io.ReadFull(br, unit); err != nil {
 				return nil, err
 			}
-			na.units = append(na.units, unit)
+			na.Units = append(na.Units, unit)
 		}
 
 		ib.nalArray = append(ib.nalArray, na)
@@ -0,0 +1,133 @@
+package bmff
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"slices"
+	"testing"
+)
+
+// rawBox returns the bytes of a box of the given type and body.
+func rawBox(typ string, body ...[]byte) []byte {
+	b := binary.BigEndian.AppendUint32(nil, 0)
+	b = append(b, typ...)
+	for _, p := range body {
+		b = append(b, p...)
+	}
+	binary.BigEndian.PutUint32(b, uint32(len(b)))
+	return b
+}
+
+// u16 and u32 return the big-endian bytes of v.
+func u16(v uint16) []byte { return binary.BigEndian.AppendUint16(nil, v) }
+func u32(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+
+func parseBox(t *testing.T, b []byte) (Box, error) {
+	t.Helper()
+	box, err := NewReader(bytes.NewReader(b)).ReadBox()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return box.Parse()
+}
+
+func TestParseItemInfo(t *testing.T) {
+	infe := rawBox("infe", []byte{2, 0, 0, 0}, u16(5), u16(0), []byte("mime"), []byte("XMP\x00"), []byte("application/rdf+xml\x00"))
+	pb, err := parseBox(t, infe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ie := pb.(*ItemInfoEntry)
+	if ie.ItemID != 5 || ie.ItemType != "mime" || ie.Name != "XMP" || ie.ContentType != "application/rdf+xml" {
+		t.Errorf("infe = %+v", ie)
+	}
+
+	// version 1 has a 32-bit entry count
+	for _, tt := range []struct {
+		version byte
+		count   []byte
+	}{
+		{0, u16(1)},
+		{1, u32(1)},
+	} {
+		pb, err := parseBox(t, rawBox("iinf", []byte{tt.version, 0, 0, 0}, tt.count, infe))
+		if err != nil {
+			t.Fatalf("iinf version %d: %v", tt.version, err)
+		}
+		ib := pb.(*ItemInfoBox)
+		if ib.Count != 1 || len(ib.ItemInfos) != 1 || ib.ItemInfos[0].ItemID != 5 {
+			t.Errorf("iinf version %d: count %d, %d entries", tt.version, ib.Count, len(ib.ItemInfos))
+		}
+	}
+}
+
+func TestParseItemLocation(t *testing.T) {
+	for _, tt := range []struct {
+		version byte
+		id      []byte
+	}{
+		{1, u16(7)},
+		{2, u32(7)},
+	} {
+		// the item count has the size of the item IDs
+		count := u16(1)
+		if tt.version == 2 {
+			count = u32(1)
+		}
+		// 4 byte offsets, lengths and extent indexes, no base offset
+		iloc := rawBox("iloc", []byte{tt.version, 0, 0, 0}, []byte{0x44, 0x04}, count,
+			tt.id, u16(1), u16(0), // construction method 1, data reference 0
+			u16(1), u32(3), u32(10), u32(20)) // one extent: index, offset, length
+		pb, err := parseBox(t, iloc)
+		if err != nil {
+			t.Fatalf("iloc version %d: %v", tt.version, err)
+		}
+		ilb := pb.(*ItemLocationBox)
+		if len(ilb.Items) != 1 {
+			t.Fatalf("iloc version %d: %d items", tt.version, len(ilb.Items))
+		}
+		ent := ilb.Items[0]
+		if ent.ItemID != 7 || ent.ConstructionMethod != 1 || !slices.Equal(ent.Extents, []OffsetLength{{Offset: 10, Length: 20, Index: 3}}) {
+			t.Errorf("iloc version %d: %+v", tt.version, ent)
+		}
+	}
+
+	iloc := rawBox("iloc", []byte{2, 0, 0, 0}, []byte{0x44, 0x04}, u32(1), u32(1<<16), u16(1), u16(0), u16(0))
+	if _, err := parseBox(t, iloc); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("iloc with item ID %d = %v; want ErrUnsupported", 1<<16, err)
+	}
+}
+
+func TestParsePrimaryItem(t *testing.T) {
+	pb, err := parseBox(t, rawBox("pitm", []byte{1, 0, 0, 0}, u32(9)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := pb.(*PrimaryItemBox).ItemID; id != 9 {
+		t.Errorf("pitm version 1 item ID = %d; want 9", id)
+	}
+}
+
+func TestParseHevcConfig(t *testing.T) {
+	config := make([]byte, 22)
+	config[0] = 1     // configurationVersion
+	config[21] = 0x03 // lengthSizeMinusOne
+	hvcc := rawBox("hvcC", config, []byte{2},
+		[]byte{0x80 | 33}, u16(1), u16(2), []byte{0x42, 0x01}, // complete SPS array
+		[]byte{34}, u16(1), u16(2), []byte{0x44, 0x01}) // incomplete PPS array
+	pb, err := parseBox(t, hvcc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	arrays := pb.(*ItemHevcConfigBox).NalArrays()
+	if len(arrays) != 2 {
+		t.Fatalf("%d NAL arrays; want 2", len(arrays))
+	}
+	for i, want := range []HevcNalArray{{1, 33, [][]byte{{0x42, 0x01}}}, {0, 34, [][]byte{{0x44, 0x01}}}} {
+		na := arrays[i]
+		if na.Completeness != want.Completeness || na.UnitType != want.UnitType || len(na.Units) != 1 || !bytes.Equal(na.Units[0], want.Units[0]) {
+			t.Errorf("NAL array %d = %+v; want %+v", i, *na, want)
+		}
+	}
+}
@@ -0,0 +1,492 @@
+package bmff
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"strings"
+)
+
+// Marshaler is implemented by parsed boxes that can encode their body,
+// that is everything after the box header, starting with the version and
+// flags of full boxes. All the parsed boxes of this package implement it.
+// The boxes of registered parsers may; otherwise they are marshaled from
+// the body they were parsed from.
+type Marshaler interface {
+	AppendBody(dst []byte) ([]byte, error)
+}
+
+// Marshal returns the encoding of b, header included.
+// See AppendBox.
+func Marshal(b Box) ([]byte, error) {
+	return AppendBox(nil, b)
+}
+
+// AppendBox appends the encoding of b, header included, to dst.
+//
+// Parsed boxes are encoded from their fields. Sizes and counts are
+// computed from the fields, and the version, flags and field sizes they
+// were parsed with are kept unless the fields no longer fit, in which
+// case the smallest that do are used. Unparsed boxes are copied from the
+// source they were read from; with NewReader, that must happen before
+// the next box is read. A box that was not modified is thus encoded as
+// the bytes it was read from.
+//
+// Errors for fields that cannot be encoded are *BoxError.
+func AppendBox(dst []byte, b Box) ([]byte, error) {
+	if bb, ok := b.(*box); ok && bb.parsed != nil {
+		b = bb.parsed
+	}
+	var base *box
+	if bb, ok := b.(interface{ base() *box }); ok {
+		base = bb.base()
+	}
+	typ := b.Type()
+	fail := func(err error) ([]byte, error) {
+		var be *BoxError
+		if errors.As(err, &be) {
+			return dst, err
+		}
+		be = &BoxError{Type: typ, Offset: -1, Err: err}
+		if base != nil {
+			be.Offset = base.offset
+		}
+		return dst, be
+	}
+
+	start := len(dst)
+	large := base != nil && base.hdrSize == 16
+	out := binary.BigEndian.AppendUint32(dst, 0)
+	out = append(out, typ[:]...)
+	if large {
+		out = binary.BigEndian.AppendUint64(out, 0)
+	}
+
+	var err error
+	if m, ok := b.(Marshaler); ok {
+		out, err = m.AppendBody(out)
+	} else if base != nil {
+		out, err = appendRawBody(out, base)
+	} else {
+		err = fmt.Errorf("%w: cannot marshal %T", ErrUnsupported, b)
+	}
+	if err != nil {
+		return fail(err)
+	}
+
+	size := uint64(len(out) - start)
+	switch {
+	case base != nil && base.toEnd && !large:
+		// keep the size of 0 of the last box of the file
+	case !large && size > math.MaxUint32:
+		out = slices.Insert(out, start+8, make([]byte, 8)...)
+		size += 8
+		large = true
+	}
+	if large {
+		binary.BigEndian.PutUint32(out[start:], 1)
+		binary.BigEndian.PutUint64(out[start+8:], size)
+	} else if !(base != nil && base.toEnd) {
+		binary.BigEndian.PutUint32(out[start:], uint32(size))
+	}
+	return out, nil
+}
+
+// appendRawBody appends the body b was read with.
+func appendRawBody(dst []byte, b *box) ([]byte, error) {
+	want := int64(-1)
+	if b.size > 0 {
+		want = b.size - b.hdrSize
+	}
+	if lr, ok := b.body.(*io.LimitedReader); ok && b.slurp == nil && !b.lazy && lr.N != want {
+		return dst, errors.New("body was already read")
+	}
+	buf := bytes.NewBuffer(dst)
+	n, err := io.Copy(buf, b.Body())
+	if err == nil && want >= 0 && n != want {
+		err = io.ErrUnexpectedEOF
+	}
+	return buf.Bytes(), err
+}
+
+func appendBoxes(dst []byte, boxes []Box) ([]byte, error) {
+	var err error
+	for _, b := range boxes {
+		if dst, err = AppendBox(dst, b); err != nil {
+			return dst, err
+		}
+	}
+	return dst, nil
+}
+
+func appendFullBoxHeader(dst []byte, version uint8, flags uint32) []byte {
+	return binary.BigEndian.AppendUint32(dst, uint32(version)<<24|flags&0xFFFFFF)
+}
+
+func appendFourCC(dst []byte, s string) ([]byte, error) {
+	if len(s) != 4 {
+		return dst, fmt.Errorf("%q is not 4 bytes long", s)
+	}
+	return append(dst, s...), nil
+}
+
+func appendString(dst []byte, s string) ([]byte, error) {
+	if strings.IndexByte(s, 0) >= 0 {
+		return dst, fmt.Errorf("string %q contains a null byte", s)
+	}
+	return append(append(dst, s...), 0), nil
+}
+
+// appendUintN appends v as a size byte big-endian integer.
+func appendUintN(dst []byte, v uint64, size uint8) []byte {
+	for i := int(size) - 1; i >= 0; i-- {
+		dst = append(dst, byte(v>>(8*i)))
+	}
+	return dst
+}
+
+func (ft *FileTypeBox) AppendBody(dst []byte) ([]byte, error) {
+	var err error
+	brands := append([]string{ft.MajorBrand, ft.MinorVersion}, ft.Compatible...)
+	for _, brand := range brands {
+		if dst, err = appendFourCC(dst, brand); err != nil {
+			return dst, err
+		}
+	}
+	return dst, nil
+}
+
+func (mb *MetaBox) AppendBody(dst []byte) ([]byte, error) {
+	dst = appendFullBoxHeader(dst, mb.Version, mb.Flags)
+	return appendBoxes(dst, mb.Children)
+}
+
+func (hb *HandlerBox) AppendBody(dst []byte) ([]byte, error) {
+	dst = appendFullBoxHeader(dst, hb.Version, hb.Flags)
+	dst = binary.BigEndian.AppendUint32(dst, 0) // pre_defined
+	dst, err := appendFourCC(dst, hb.HandlerType)
+	if err != nil {
+		return dst, err
+	}
+	dst = append(dst, make([]byte, 12)...) // reserved
+	dst, err = appendString(dst, hb.Name)
+	return append(dst, hb.trailer...), err
+}
+
+func (dib *DataInformationBox) AppendBody(dst []byte) ([]byte, error) {
+	return appendBoxes(dst, dib.Children)
+}
+
+func (drb *DataReferenceBox) AppendBody(dst []byte) ([]byte, error) {
+	dst = appendFullBoxHeader(dst, drb.Version, drb.Flags)
+	dst = binary.BigEndian.AppendUint32(dst, uint32(len(drb.Children)))
+	return appendBoxes(dst, drb.Children)
+}
+
+func (pib *PrimaryItemBox) AppendBody(dst []byte) ([]byte, error) {
+	dst = appendFullBoxHeader(dst, pib.Version, pib.Flags)
+	if pib.Version == 0 {
+		return binary.BigEndian.AppendUint16(dst, pib.ItemID), nil
+	}
+	return binary.BigEndian.AppendUint32(dst, uint32(pib.ItemID)), nil
+}
+
+// AppendBody appends the item data. Despite the embedded FullBox, an
+// idat box has no version and flags.
+func (idb *ItemDataBox) AppendBody(dst []byte) ([]byte, error) {
+	return append(dst, idb.Data...), nil
+}
+
+func (ie *ItemInfoEntry) AppendBody(dst []byte) ([]byte, error) {
+	// only version 2 is supported, as by parseItemInfoEntry
+	dst = appendFullBoxHeader(dst, 2, ie.Flags)
+	dst = binary.BigEndian.AppendUint16(dst, ie.ItemID)
+	dst = binary.BigEndian.AppendUint16(dst, ie.ProtectionIndex)
+	dst, err := appendFourCC(dst, ie.ItemType)
+	if err == nil {
+		dst, err = appendString(dst, ie.Name)
+	}
+	switch ie.ItemType {
+	case "mime":
+		if err == nil {
+			dst, err = appendString(dst, ie.ContentType)
+		}
+		if err == nil && ie.ContentEncoding != "" {
+			dst, err = appendString(dst, ie.ContentEncoding)
+		}
+	case "uri ":
+		if err == nil {
+			dst, err = appendString(dst, ie.ItemURIType)
+		}
+	}
+	return dst, err
+}
+
+func (ib *ItemInfoBox) AppendBody(dst []byte) ([]byte, error) {
+	version := ib.Version
+	if version == 0 && len(ib.ItemInfos) > math.MaxUint16 {
+		version = 1
+	}
+	dst = appendFullBoxHeader(dst, version, ib.Flags)
+	if version == 0 {
+		dst = binary.BigEndian.AppendUint16(dst, uint16(len(ib.ItemInfos)))
+	} else {
+		dst = binary.BigEndian.AppendUint32(dst, uint32(len(ib.ItemInfos)))
+	}
+	var err error
+	for _, ie := range ib.ItemInfos {
+		if dst, err = AppendBox(dst, ie); err != nil {
+			return dst, err
+		}
+	}
+	return dst, nil
+}
+
+func (ib *ItemReferenceBox) AppendBody(dst []byte) ([]byte, error) {
+	version := ib.Version
+	for _, ref := range ib.ItemRefs {
+		if ref.FromItemID > math.MaxUint16 {
+			version = max(version, 1)
+		}
+		for _, id := range ref.ToItemIDs {
+			if id > math.MaxUint16 {
+				version = max(version, 1)
+			}
+		}
+	}
+	dst = appendFullBoxHeader(dst, version, ib.Flags)
+	var err error
+	for _, ref := range ib.ItemRefs {
+		if dst, err = AppendBox(dst, itemReference{ref, version}); err != nil {
+			return dst, err
+		}
+	}
+	return dst, nil
+}
+
+// itemReference marshals an ItemReferenceEntry, whose encoding depends
+// on the version of its ItemReferenceBox.
+type itemReference struct {
+	*ItemReferenceEntry
+	version uint8
+}
+
+func (ir itemReference) AppendBody(dst []byte) ([]byte, error) {
+	if len(ir.ToItemIDs) > math.MaxUint16 {
+		return dst, fmt.Errorf("%d references", len(ir.ToItemIDs))
+	}
+	appendID := func(dst []byte, id uint32) []byte {
+		if ir.version == 0 {
+			return binary.BigEndian.AppendUint16(dst, uint16(id))
+		}
+		return binary.BigEndian.AppendUint32(dst, id)
+	}
+	dst = appendID(dst, ir.FromItemID)
+	dst = binary.BigEndian.AppendUint16(dst, uint16(len(ir.ToItemIDs)))
+	for _, id := range ir.ToItemIDs {
+		dst = appendID(dst, id)
+	}
+	return dst, nil
+}
+
+func (ipc *ItemPropertyContainerBox) AppendBody(dst []byte) ([]byte, error) {
+	return appendBoxes(dst, ipc.Properties)
+}
+
+func (ip *ItemPropertiesBox) AppendBody(dst []byte) ([]byte, error) {
+	if ip.PropertyContainer == nil {
+		return dst, errors.New("no ipco box")
+	}
+	dst, err := AppendBox(dst, ip.PropertyContainer)
+	for _, ipa := range ip.Associations {
+		if err != nil {
+			break
+		}
+		dst, err = AppendBox(dst, ipa)
+	}
+	return dst, err
+}
+
+func (ipa *ItemPropertyAssociation) AppendBody(dst []byte) ([]byte, error) {
+	version, flags := ipa.Version, ipa.Flags
+	for _, ent := range ipa.Entries {
+		if ent.ItemID > math.MaxUint16 {
+			version = max(version, 1)
+		}
+		if len(ent.Associations) > math.MaxUint8 {
+			return dst, fmt.Errorf("%d properties for item %d", len(ent.Associations), ent.ItemID)
+		}
+		for _, p := range ent.Associations {
+			if p.Index > 0x7FFF {
+				return dst, fmt.Errorf("property index %d", p.Index)
+			}
+			if p.Index > 0x7F {
+				flags |= 1
+			}
+		}
+	}
+
+	dst = appendFullBoxHeader(dst, version, flags)
+	dst = binary.BigEndian.AppendUint32(dst, uint32(len(ipa.Entries)))
+	for _, ent := range ipa.Entries {
+		if version < 1 {
+			dst = binary.BigEndian.AppendUint16(dst, uint16(ent.ItemID))
+		} else {
+			dst = binary.BigEndian.AppendUint32(dst, ent.ItemID)
+		}
+		dst = append(dst, uint8(len(ent.Associations)))
+		for _, p := range ent.Associations {
+			var essential uint16
+			if p.Essential {
+				essential = 1
+			}
+			if flags&1 != 0 {
+				dst = binary.BigEndian.AppendUint16(dst, essential<<15|p.Index)
+			} else {
+				dst = append(dst, uint8(essential<<7|p.Index))
+			}
+		}
+	}
+	return dst, nil
+}
+
+func (isp *ImageSpatialExtentsProperty) AppendBody(dst []byte) ([]byte, error) {
+	dst = appendFullBoxHeader(dst, isp.Version, isp.Flags)
+	dst = binary.BigEndian.AppendUint32(dst, isp.ImageWidth)
+	return binary.BigEndian.AppendUint32(dst, isp.ImageHeight), nil
+}
+
+func (ir *ImageRotation) AppendBody(dst []byte) ([]byte, error) {
+	if ir.Angle > 3 {
+		return dst, fmt.Errorf("rotation %d", ir.Angle)
+	}
+	return append(dst, ir.Angle), nil
+}
+
+func (im *ImageMirror) AppendBody(dst []byte) ([]byte, error) {
+	if im.Mirror > 1 {
+		return dst, fmt.Errorf("mirror axis %d", im.Mirror)
+	}
+	return append(dst, im.Mirror), nil
+}
+
+func (c *CleanAperture) AppendBody(dst []byte) ([]byte, error) {
+	for _, v := range []uint32{c.WidthN, c.WidthD, c.HeightN, c.HeightD, uint32(c.HorizOffN), c.HorizOffD, uint32(c.VertOffN), c.VertOffD} {
+		dst = binary.BigEndian.AppendUint32(dst, v)
+	}
+	return dst, nil
+}
+
+// ilocFieldSize returns the size in bytes of an iloc field holding values
+// up to max: size if they fit, else the smallest of 4 and 8 that does.
+func ilocFieldSize(size uint8, max uint64) uint8 {
+	if size >= 8 || max < 1<<(8*uint(size)) {
+		return size
+	}
+	if max <= math.MaxUint32 {
+		return 4
+	}
+	return 8
+}
+
+func (ilb *ItemLocationBox) AppendBody(dst []byte) ([]byte, error) {
+	version := ilb.Version
+	var maxOffset, maxLength, maxBase, maxIndex uint64
+	for _, ent := range ilb.Items {
+		if ent.ConstructionMethod > 15 {
+			return dst, fmt.Errorf("construction method %d", ent.ConstructionMethod)
+		}
+		if ent.ConstructionMethod != 0 {
+			version = max(version, 1)
+		}
+		if len(ent.Extents) > math.MaxUint16 {
+			return dst, fmt.Errorf("%d extents for item %d", len(ent.Extents), ent.ItemID)
+		}
+		maxBase = max(maxBase, ent.BaseOffset)
+		for _, ol := range ent.Extents {
+			maxOffset = max(maxOffset, ol.Offset)
+			maxLength = max(maxLength, ol.Length)
+			maxIndex = max(maxIndex, ol.Index)
+		}
+	}
+	if maxIndex > 0 {
+		version = max(version, 1)
+	}
+	offsetSize := ilocFieldSize(ilb.offsetSize, maxOffset)
+	lengthSize := ilocFieldSize(ilb.lengthSize, maxLength)
+	baseOffsetSize := ilocFieldSize(ilb.baseOffsetSize, maxBase)
+	var indexSize uint8
+	if version > 0 {
+		indexSize = ilocFieldSize(ilb.indexSize, maxIndex)
+	}
+
+	dst = appendFullBoxHeader(dst, version, ilb.Flags)
+	dst = append(dst, offsetSize<<4|lengthSize, baseOffsetSize<<4|indexSize)
+	appendID := func(dst []byte, id uint16) []byte {
+		if version < 2 {
+			return binary.BigEndian.AppendUint16(dst, id)
+		}
+		return binary.BigEndian.AppendUint32(dst, uint32(id))
+	}
+	if version < 2 && len(ilb.Items) > math.MaxUint16 {
+		return dst, fmt.Errorf("%d items", len(ilb.Items))
+	}
+	dst = appendID(dst, uint16(len(ilb.Items)))
+	for _, ent := range ilb.Items {
+		dst = appendID(dst, ent.ItemID)
+		if version > 0 {
+			dst = binary.BigEndian.AppendUint16(dst, uint16(ent.ConstructionMethod))
+		}
+		dst = binary.BigEndian.AppendUint16(dst, ent.DataReferenceIndex)
+		dst = appendUintN(dst, ent.BaseOffset, baseOffsetSize)
+		dst = binary.BigEndian.AppendUint16(dst, uint16(len(ent.Extents)))
+		for _, ol := range ent.Extents {
+			dst = appendUintN(dst, ol.Index, indexSize)
+			dst = appendUintN(dst, ol.Offset, offsetSize)
+			dst = appendUintN(dst, ol.Length, lengthSize)
+		}
+	}
+	return dst, nil
+}
+
+func (ib *ItemHevcConfigBox) AppendBody(dst []byte) ([]byte, error) {
+	c := &ib.config
+	dst = append(dst,
+		c.Version,
+		c.GeneralProfileSpace<<6|(c.GeneralTierFlag&1)<<5|c.GeneralProfileIdc&0x1F)
+	dst = binary.BigEndian.AppendUint32(dst, c.GeneralProfileCompatibilityFlags)
+	dst = appendUintN(dst, c.GeneralConstraintIndicatorFlags, 6)
+	dst = append(dst, c.GeneralLevelIdc)
+	dst = binary.BigEndian.AppendUint16(dst, 0xF000|c.MinSpatialSegmentationIdc&0x0FFF)
+	dst = append(dst,
+		0xFC|c.ParallelismType&3,
+		0xFC|c.ChromaFormat&3,
+		0xF8|(c.BitDepthLuma-8)&7,
+		0xF8|(c.BitDepthChroma-8)&7)
+	dst = binary.BigEndian.AppendUint16(dst, c.AvgFrameRate)
+	dst = append(dst, c.ConstantFrameRate<<6|(c.NumTemporalLayers&7)<<3|(c.TemporalIdNested&1)<<2|c.LengthSizeMinusOne&3)
+
+	if len(ib.nalArray) > math.MaxUint8 {
+		return dst, fmt.Errorf("%d NAL unit arrays", len(ib.nalArray))
+	}
+	dst = append(dst, uint8(len(ib.nalArray)))
+	for _, na := range ib.nalArray {
+		if len(na.Units) > math.MaxUint16 {
+			return dst, fmt.Errorf("%d NAL units of type %d", len(na.Units), na.UnitType)
+		}
+		dst = append(dst, (na.Completeness&1)<<7|na.UnitType&0x3F)
+		dst = binary.BigEndian.AppendUint16(dst, uint16(len(na.Units)))
+		for _, unit := range na.Units {
+			if len(unit) > math.MaxUint16 {
+				return dst, fmt.Errorf("NAL unit of %d bytes", len(unit))
+			}
+			dst = binary.BigEndian.AppendUint16(dst, uint16(len(unit)))
+			dst = append(dst, unit...)
+		}
+	}
+	return dst, nil
+}
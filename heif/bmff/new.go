@@ -0,0 +1,90 @@
+package bmff
+
+import (
+	"bytes"
+	"image"
+)
+
+// The functions below create boxes to be marshaled, for writing files.
+// Box types with a FullBox are created as composite literals, e.g.
+//
+//	&ImageSpatialExtentsProperty{FullBox: NewFullBox(TypeIspe, 0, 0), ImageWidth: w, ImageHeight: h}
+
+func newBox(typ BoxType) *box {
+	return &box{boxType: typ, offset: -1}
+}
+
+// NewFullBox returns the FullBox of a new box of the given type.
+func NewFullBox(typ BoxType, version uint8, flags uint32) FullBox {
+	return FullBox{box: newBox(typ), Version: version, Flags: flags}
+}
+
+// NewBox returns a box of the given type and body, for box types that
+// have no parser. The body is marshaled unchanged; for full boxes, it
+// starts with the version and flags.
+func NewBox(typ BoxType, body []byte) Box {
+	b := newBox(typ)
+	if body == nil {
+		body = []byte{}
+	}
+	b.slurp = body
+	b.body = bytes.NewReader(body)
+	b.size = 8 + int64(len(body))
+	b.hdrSize = 8
+	return b
+}
+
+// NewFileTypeBox returns an "ftyp" box.
+func NewFileTypeBox(major, minor string, compatible ...string) *FileTypeBox {
+	return &FileTypeBox{box: newBox(TypeFtyp), MajorBrand: major, MinorVersion: minor, Compatible: compatible}
+}
+
+// NewDataInformationBox returns a "dinf" box.
+func NewDataInformationBox(children ...Box) *DataInformationBox {
+	return &DataInformationBox{box: newBox(BoxType{'d', 'i', 'n', 'f'}), Children: children}
+}
+
+// NewItemPropertiesBox returns an "iprp" box holding the given properties
+// in its "ipco" box.
+func NewItemPropertiesBox(properties []Box, associations ...*ItemPropertyAssociation) *ItemPropertiesBox {
+	return &ItemPropertiesBox{
+		box:               newBox(BoxType{'i', 'p', 'r', 'p'}),
+		PropertyContainer: &ItemPropertyContainerBox{box: newBox(BoxType{'i', 'p', 'c', 'o'}), Properties: properties},
+		Associations:      associations,
+	}
+}
+
+// NewItemReferenceEntry returns a reference of the given type, such as
+// "dimg", from one item to others.
+func NewItemReferenceEntry(typ BoxType, from uint32, to ...uint32) *ItemReferenceEntry {
+	return &ItemReferenceEntry{box: newBox(typ), FromItemID: from, Count: uint16(len(to)), ToItemIDs: to}
+}
+
+// NewImageRotation returns an "irot" property of angle times 90 degrees
+// counter-clockwise.
+func NewImageRotation(angle uint8) *ImageRotation {
+	return &ImageRotation{box: newBox(BoxType{'i', 'r', 'o', 't'}), Angle: angle}
+}
+
+// NewImageMirror returns an "imir" property, mirroring about the axis
+// MirrorVertical or MirrorHorizontal.
+func NewImageMirror(axis uint8) *ImageMirror {
+	return &ImageMirror{box: newBox(BoxType{'i', 'm', 'i', 'r'}), Mirror: axis}
+}
+
+// NewCleanAperture returns a "clap" property cropping an image of the
+// given size to r. Its offsets are in halves of pixels.
+func NewCleanAperture(r image.Rectangle, width, height int) *CleanAperture {
+	return &CleanAperture{
+		box:    newBox(BoxType{'c', 'l', 'a', 'p'}),
+		WidthN: uint32(r.Dx()), WidthD: 1,
+		HeightN: uint32(r.Dy()), HeightD: 1,
+		HorizOffN: int32(2*r.Min.X + r.Dx() - width), HorizOffD: 2,
+		VertOffN: int32(2*r.Min.Y + r.Dy() - height), VertOffD: 2,
+	}
+}
+
+// NewItemHevcConfigBox returns an "hvcC" property.
+func NewItemHevcConfigBox(config HevcConfig, arrays []*HevcNalArray) *ItemHevcConfigBox {
+	return &ItemHevcConfigBox{box: newBox(BoxType{'h', 'v', 'c', 'C'}), config: config, nalArray: arrays}
+}
@@ -0,0 +1,208 @@
+package bmff
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// ParserFunc parses the body of a box of a registered type. The returned
+// box usually embeds br.Box(), or the FullBox from br.ReadFullBoxHeader,
+// so it implements Box.
+type ParserFunc func(br *BoxReader) (Box, error)
+
+var registry struct {
+	sync.RWMutex
+	types map[BoxType]ParserFunc
+	uuids map[[16]byte]ParserFunc
+}
+
+// RegisterParser registers the parser of a box type unknown to this
+// package, such as a vendor property. Parsed boxes of that type, e.g. in
+// heif.Item.Properties, are then the values returned by fn. It panics if
+// the type already has a parser; "uuid" boxes are registered by their
+// user type with RegisterUUIDParser.
+func RegisterParser(typ BoxType, fn ParserFunc) {
+	registry.Lock()
+	defer registry.Unlock()
+	if _, ok := parsers[typ]; ok || registry.types[typ] != nil {
+		panic(fmt.Sprintf("bmff: parser for %q registered twice", typ))
+	}
+	if registry.types == nil {
+		registry.types = make(map[BoxType]ParserFunc)
+	}
+	registry.types[typ] = fn
+}
+
+// RegisterUUIDParser registers the parser of the "uuid" boxes with the
+// given user type. The parser is called after the user type was read.
+// It panics if the user type already has a parser.
+func RegisterUUIDParser(userType [16]byte, fn ParserFunc) {
+	registry.Lock()
+	defer registry.Unlock()
+	if registry.uuids[userType] != nil {
+		panic(fmt.Sprintf("bmff: parser for uuid %x registered twice", userType))
+	}
+	if registry.uuids == nil {
+		registry.uuids = make(map[[16]byte]ParserFunc)
+	}
+	registry.uuids[userType] = fn
+}
+
+// parserFor returns the parser of a box type, built in or registered.
+func parserFor(typ BoxType) (parserFunc, bool) {
+	if p, ok := parsers[typ]; ok {
+		return p, true
+	}
+	registry.RLock()
+	defer registry.RUnlock()
+	if fn, ok := registry.types[typ]; ok {
+		return func(b *box, br *bufReader) (Box, error) {
+			return fn(&BoxReader{box: b, br: br})
+		}, true
+	}
+	if typ == boxType("uuid") && len(registry.uuids) > 0 {
+		return parseUUIDBox, true
+	}
+	return nil, false
+}
+
+func parseUUIDBox(b *box, br *bufReader) (Box, error) {
+	buf, err := br.Peek(16)
+	if err != nil {
+		return nil, err
+	}
+	var userType [16]byte
+	copy(userType[:], buf)
+
+	registry.RLock()
+	fn, ok := registry.uuids[userType]
+	registry.RUnlock()
+	if !ok {
+		return nil, ErrUnknownBox
+	}
+	br.Discard(16)
+	return fn(&BoxReader{box: b, br: br})
+}
+
+// BoxReader reads the body of a box for a ParserFunc. Reads past the end
+// of the body fail with an error that the parser should return; after
+// the first failure, all reads fail.
+type BoxReader struct {
+	box *box
+	br  *bufReader
+}
+
+// Box returns the box being parsed, for embedding in the parsed value.
+func (r *BoxReader) Box() Box {
+	return r.box
+}
+
+// Offset returns the position of the next unread byte, or -1 if unknown.
+func (r *BoxReader) Offset() int64 {
+	return r.br.offset()
+}
+
+// Err returns the first error of a read.
+func (r *BoxReader) Err() error {
+	return r.br.err
+}
+
+// ReadFullBoxHeader reads the version and flags of a full box.
+func (r *BoxReader) ReadFullBoxHeader() (FullBox, error) {
+	if r.br.err != nil {
+		return FullBox{}, r.br.err
+	}
+	fb, err := readFullBox(r.box, r.br)
+	if err != nil {
+		r.br.err = err
+	}
+	return fb, err
+}
+
+func (r *BoxReader) ReadUint8() (uint8, error) {
+	return r.br.readUint8()
+}
+
+func (r *BoxReader) ReadUint16() (uint16, error) {
+	return r.br.readUint16()
+}
+
+func (r *BoxReader) ReadUint32() (uint32, error) {
+	return r.br.readUint32()
+}
+
+func (r *BoxReader) ReadUint64() (uint64, error) {
+	return r.br.readUintN(64)
+}
+
+// ReadUintN reads a big-endian integer of 0, 8, 16, 32 or 64 bits, as
+// used for fields whose size is given by another field.
+func (r *BoxReader) ReadUintN(bits uint8) (uint64, error) {
+	return r.br.readUintN(bits)
+}
+
+// ReadString reads a null-terminated string.
+func (r *BoxReader) ReadString() (string, error) {
+	return r.br.readString()
+}
+
+// ReadBytes reads n bytes.
+func (r *BoxReader) ReadBytes(n int) ([]byte, error) {
+	if r.br.err != nil {
+		return nil, r.br.err
+	}
+	// check n before allocating, it usually comes from the file
+	if n < 0 {
+		r.br.err = fmt.Errorf("read of %d bytes", n)
+		return nil, r.br.err
+	}
+	if remain, ok := r.remain(); ok && int64(n) > remain {
+		r.br.err = fmt.Errorf("read of %d bytes with %d bytes left in the box", n, remain)
+		return nil, r.br.err
+	}
+	if err := r.box.budget.addBytes(int64(n)); err != nil {
+		r.br.err = err
+		return nil, err
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r.br, buf); err != nil {
+		r.br.err = err
+		return nil, err
+	}
+	return buf, nil
+}
+
+// remain returns the number of unread bytes of the body, if the box size
+// is known.
+func (r *BoxReader) remain() (int64, bool) {
+	if r.box.size <= 0 {
+		return 0, false
+	}
+	read := r.br.cr.n - int64(r.br.Buffered())
+	return r.box.size - r.box.hdrSize - read, true
+}
+
+// ReadAll reads the rest of the body.
+func (r *BoxReader) ReadAll() ([]byte, error) {
+	if r.br.err != nil {
+		return nil, r.br.err
+	}
+	buf, err := io.ReadAll(r.br)
+	if err == nil {
+		err = r.box.budget.addBytes(int64(len(buf)))
+	}
+	if err != nil {
+		r.br.err = err
+		return nil, err
+	}
+	return buf, nil
+}
+
+// ReadBoxes parses the rest of the body as a sequence of boxes, for
+// container boxes. The boxes are returned unparsed.
+func (r *BoxReader) ReadBoxes() ([]Box, error) {
+	var boxes []Box
+	err := r.br.parseAppendBoxes(&boxes)
+	return boxes, err
+}
@@ -0,0 +1,49 @@
+package bmff
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+func TestReadBytesBounds(t *testing.T) {
+	var n int
+	RegisterParser(boxType("rbtb"), func(br *BoxReader) (Box, error) {
+		if _, err := br.ReadBytes(2); err != nil {
+			return nil, err
+		}
+		if _, err := br.ReadBytes(n); err != nil {
+			return nil, err
+		}
+		return br.Box(), nil
+	})
+
+	// a box with a body of 6 bytes
+	b := binary.BigEndian.AppendUint32(nil, 8+6)
+	b = append(b, "rbtb"...)
+	b = append(b, make([]byte, 6)...)
+
+	for _, tt := range []struct {
+		n  int
+		ok bool
+	}{
+		{4, true},
+		{5, false},
+		{1 << 40, false},
+		{-1, false},
+	} {
+		n = tt.n
+		box, err := NewReader(bytes.NewReader(b)).ReadBox()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = box.Parse()
+		if tt.ok && err != nil {
+			t.Errorf("ReadBytes(%d) = %v", tt.n, err)
+		}
+		if !tt.ok && !errors.Is(err, ErrCorrupt) {
+			t.Errorf("ReadBytes(%d) = %v; want ErrCorrupt", tt.n, err)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package bmff
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// SkipChildren is returned by a WalkFunc to skip the boxes nested in the
+// current one.
+var SkipChildren = errors.New("bmff: skip children")
+
+// BoxInfo describes a box found by Walk.
+type BoxInfo struct {
+	Type       BoxType
+	Offset     int64     // of the header
+	HeaderSize int64     // size, type, largesize and uuid user type
+	Size       int64     // including the header
+	Path       []BoxType // of the enclosing boxes, outermost first
+
+	// Box is the parsed box, or nil for containers, whose children are
+	// reported on their own, for boxes of unknown type, and for boxes that
+	// failed to parse, in which case Err is set.
+	Box Box
+	Err error
+}
+
+// PayloadSize returns the size of the box without its header.
+func (bi *BoxInfo) PayloadSize() int64 {
+	return bi.Size - bi.HeaderSize
+}
+
+// MaxWalkDepth is the deepest nesting of boxes Walk descends into.
+const MaxWalkDepth = 32
+
+// DefaultWalkLimits are the limits of Walk.
+var DefaultWalkLimits = Limits{MaxMetadataBytes: 64 << 20}
+
+// WalkFunc is called by Walk for every box. Returning SkipChildren skips
+// the boxes nested in this one; any other error stops the walk.
+type WalkFunc func(bi *BoxInfo) error
+
+// containers lists the boxes whose payload is a sequence of boxes, with
+// the size of the fields that precede them. iinf is handled by
+// childrenOffset as the size of its entry count depends on its version.
+var containers = map[BoxType]int64{
+	boxType("meta"): 4,
+	boxType("iprp"): 0,
+	boxType("ipco"): 0,
+	boxType("dinf"): 0,
+	boxType("dref"): 8,
+	boxType("iref"): 4,
+	boxType("iinf"): 4,
+	boxType("grpl"): 0,
+	boxType("moov"): 0,
+	boxType("trak"): 0,
+	boxType("edts"): 0,
+	boxType("mdia"): 0,
+	boxType("minf"): 0,
+	boxType("stbl"): 0,
+	boxType("udta"): 0,
+	boxType("mvex"): 0,
+	boxType("moof"): 0,
+	boxType("traf"): 0,
+}
+
+// Walk calls fn for every box in the first size bytes of r, in file order,
+// descending into known container boxes. Containers and unknown boxes are
+// reported without a parsed value. The other boxes are parsed on their
+// own, so those whose parsing depends on their parent, such as the
+// entries of iref, are not parsed.
+//
+// Walk returns a *BoxError if the box structure itself is corrupt, or
+// nested deeper than MaxWalkDepth. A box extending past its parent or the
+// input is still passed to fn, with that error in Err, before Walk
+// returns.
+//
+// The boxes found and the data of the parsed boxes are charged to
+// DefaultWalkLimits; Walk returns a *BoxError wrapping ErrLimitExceeded
+// once they are exceeded.
+func Walk(r io.ReaderAt, size int64, fn WalkFunc) error {
+	return WalkWithLimits(r, size, DefaultWalkLimits, fn)
+}
+
+// WalkWithLimits is like Walk with the given limits instead of
+// DefaultWalkLimits.
+func WalkWithLimits(r io.ReaderAt, size int64, l Limits, fn WalkFunc) error {
+	return walk(r, 0, size, nil, &budget{limits: l}, fn)
+}
+
+func walk(r io.ReaderAt, pos, end int64, path []BoxType, bud *budget, fn WalkFunc) error {
+	for pos < end {
+		bi, err := readBoxInfo(r, pos, end)
+		if bi != nil {
+			bi.Path = path
+		}
+		if err != nil {
+			if bi != nil {
+				// report the truncated box before giving up
+				bi.Err = err
+				if ferr := fn(bi); ferr != nil && ferr != SkipChildren {
+					return ferr
+				}
+			}
+			return err
+		}
+		if err := bud.addBox(); err != nil {
+			return &BoxError{Type: bi.Type, Offset: bi.Offset, Err: err}
+		}
+
+		_, container := containers[bi.Type]
+		if parser, ok := parserFor(bi.Type); ok && !container {
+			hdrSize := bi.HeaderSize
+			if bi.Type == boxType("uuid") {
+				hdrSize -= 16 // the parser reads the user type
+			}
+			b := &box{
+				size:    bi.Size,
+				boxType: bi.Type,
+				offset:  bi.Offset,
+				hdrSize: hdrSize,
+				body:    io.NewSectionReader(r, bi.Offset+hdrSize, bi.Size-hdrSize),
+				budget:  bud,
+			}
+			switch v, err := parser(b, b.newBufReader()); {
+			case err == ErrUnknownBox:
+				// a "uuid" box of an unregistered user type
+			case errors.Is(err, ErrLimitExceeded):
+				return b.boxError(err)
+			case err != nil:
+				bi.Err = b.boxError(err)
+			default:
+				bi.Box = v
+			}
+		}
+
+		err = fn(bi)
+		if err != nil && err != SkipChildren {
+			return err
+		}
+		if err == nil {
+			if start, ok := childrenOffset(r, bi); ok {
+				if len(path) >= MaxWalkDepth-1 {
+					return &BoxError{Type: bi.Type, Offset: bi.Offset, Err: corrupt(fmt.Errorf("boxes nested deeper than %d", MaxWalkDepth))}
+				}
+				children := append(path[:len(path):len(path)], bi.Type)
+				if err := walk(r, start, bi.Offset+bi.Size, children, bud, fn); err != nil {
+					return err
+				}
+			}
+		}
+		pos += bi.Size
+	}
+	return nil
+}
+
+// readBoxInfo reads the header of the box at pos, which must end by end.
+func readBoxInfo(r io.ReaderAt, pos, end int64) (*BoxInfo, error) {
+	bi := &BoxInfo{Offset: pos, HeaderSize: 8}
+	fail := func(err error) (*BoxInfo, error) {
+		return nil, &BoxError{Type: bi.Type, Offset: pos, Err: corrupt(err)}
+	}
+
+	var buf [16]byte
+	if end-pos < 8 {
+		return fail(fmt.Errorf("%d trailing bytes", end-pos))
+	}
+	if _, err := r.ReadAt(buf[:8], pos); err != nil {
+		return fail(err)
+	}
+	copy(bi.Type[:], buf[4:8])
+
+	switch size := binary.BigEndian.Uint32(buf[:4]); size {
+	case 0: // to the end
+		bi.Size = end - pos
+	case 1:
+		if end-pos < 16 {
+			return fail(io.ErrUnexpectedEOF)
+		}
+		if _, err := r.ReadAt(buf[8:16], pos+8); err != nil {
+			return fail(err)
+		}
+		bi.HeaderSize = 16
+		bi.Size = int64(binary.BigEndian.Uint64(buf[8:16]))
+	default:
+		bi.Size = int64(size)
+	}
+	if bi.Type == boxType("uuid") {
+		bi.HeaderSize += 16
+	}
+
+	if bi.Size < bi.HeaderSize {
+		return fail(fmt.Errorf("box size %d out of range", bi.Size))
+	}
+	if bi.Size > end-pos {
+		return bi, &BoxError{Type: bi.Type, Offset: pos, Err: corrupt(fmt.Errorf("box size %d exceeds the %d bytes left", bi.Size, end-pos))}
+	}
+	return bi, nil
+}
+
+// childrenOffset returns the offset of the first child of a container box.
+func childrenOffset(r io.ReaderAt, bi *BoxInfo) (int64, bool) {
+	prefix, ok := containers[bi.Type]
+	if !ok {
+		return 0, false
+	}
+	if bi.Type == boxType("iinf") {
+		var version [1]byte
+		if _, err := r.ReadAt(version[:], bi.Offset+bi.HeaderSize); err != nil {
+			return 0, false
+		}
+		if version[0] == 0 {
+			prefix += 2
+		} else {
+			prefix += 4
+		}
+	}
+	if prefix > bi.PayloadSize() {
+		return 0, false
+	}
+	return bi.Offset + bi.HeaderSize + prefix, true
+}
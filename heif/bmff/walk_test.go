@@ -0,0 +1,141 @@
+package bmff
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestWalk(t *testing.T) {
+	f, err := os.Open("../testdata/park.heic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the test file is cut off in the middle of the mdat box
+	var top int64
+	count := map[string]int{}
+	err = Walk(f, fi.Size(), func(bi *BoxInfo) error {
+		if bi.Err != nil && bi.Type != boxType("mdat") {
+			t.Errorf("%q box at %d: %v", bi.Type, bi.Offset, bi.Err)
+		}
+		if _, ok := containers[bi.Type]; ok && bi.Box != nil {
+			t.Errorf("%q box at %d: container was parsed", bi.Type, bi.Offset)
+		}
+		if ob, ok := bi.Box.(OffsetBox); ok && ob.Offset() != bi.Offset {
+			t.Errorf("%q box at %d: parsed box has offset %d", bi.Type, bi.Offset, ob.Offset())
+		}
+		if len(bi.Path) == 0 {
+			if bi.Offset != top {
+				t.Errorf("%q box at %d; want %d", bi.Type, bi.Offset, top)
+			}
+			top += bi.Size
+		}
+
+		var path []string
+		for _, typ := range bi.Path {
+			path = append(path, typ.String())
+		}
+		count[strings.Join(append(path, bi.Type.String()), "/")]++
+		return nil
+	})
+	var be *BoxError
+	if !errors.As(err, &be) || be.Type != boxType("mdat") {
+		t.Fatalf("Walk = %v; want a *BoxError for the mdat box", err)
+	}
+
+	for key, want := range map[string]int{
+		"ftyp":                1,
+		"meta":                1,
+		"mdat":                1,
+		"meta/iinf/infe":      52,
+		"meta/iprp/ipco/hvcC": 2,
+		"meta/iref/dimg":      1,
+	} {
+		if got := count[key]; got != want {
+			t.Errorf("%d %s boxes; want %d", got, key, want)
+		}
+	}
+}
+
+func TestWalkCorrupt(t *testing.T) {
+	b, err := os.ReadFile("../testdata/park.heic")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = Walk(strings.NewReader(string(b[:2000])), 2000, func(bi *BoxInfo) error {
+		return SkipChildren
+	})
+	var be *BoxError
+	if !errors.As(err, &be) || !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("Walk of truncated file = %v; want a *BoxError wrapping ErrCorrupt", err)
+	}
+}
+
+func TestWalkDepth(t *testing.T) {
+	// moov boxes nested one deeper than Walk descends
+	var b []byte
+	for i := 0; i < MaxWalkDepth+1; i++ {
+		b = append(binary.BigEndian.AppendUint32(nil, uint32(8+len(b))), append([]byte("moov"), b...)...)
+	}
+
+	var deepest int
+	err := Walk(strings.NewReader(string(b)), int64(len(b)), func(bi *BoxInfo) error {
+		deepest = max(deepest, len(bi.Path)+1)
+		return nil
+	})
+	var be *BoxError
+	if !errors.As(err, &be) || !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("Walk of deeply nested boxes = %v; want a *BoxError wrapping ErrCorrupt", err)
+	}
+	if deepest != MaxWalkDepth {
+		t.Errorf("Walk descended %d boxes deep; want %d", deepest, MaxWalkDepth)
+	}
+}
+
+// largeIdat is a file of a single idat box of 1 TiB, all zeros.
+type largeIdat struct{}
+
+func (largeIdat) ReadAt(p []byte, off int64) (int, error) {
+	hdr := []byte{0, 0, 0, 1, 'i', 'd', 'a', 't', 0, 0, 1, 0, 0, 0, 0, 0}
+	for i := range p {
+		p[i] = 0
+		if off+int64(i) < int64(len(hdr)) {
+			p[i] = hdr[off+int64(i)]
+		}
+	}
+	return len(p), nil
+}
+
+func TestWalkLimits(t *testing.T) {
+	err := Walk(largeIdat{}, 1<<40, func(bi *BoxInfo) error {
+		t.Errorf("%q box of %d bytes passed to fn", bi.Type, bi.Size)
+		return nil
+	})
+	var be *BoxError
+	if !errors.As(err, &be) || be.Type != TypeIdat || !errors.Is(err, ErrLimitExceeded) {
+		t.Errorf("Walk of a large idat box = %v; want a *BoxError wrapping ErrLimitExceeded", err)
+	}
+
+	f, err := os.Open("../testdata/park.heic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = WalkWithLimits(f, fi.Size(), Limits{MaxBoxes: 10}, func(bi *BoxInfo) error { return nil })
+	if !errors.Is(err, ErrLimitExceeded) {
+		t.Errorf("WalkWithLimits with MaxBoxes = %v; want ErrLimitExceeded", err)
+	}
+}
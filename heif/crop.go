@@ -0,0 +1,200 @@
+package heif
+
+import (
+	"encoding/binary"
+	"fmt"
+	"image"
+	"slices"
+
+	"github.com/jdeng/goheif/heif/bmff"
+)
+
+// imageGrid is the data of a "grid" item.
+type imageGrid struct {
+	rows, columns int
+	width, height int
+}
+
+func parseImageGrid(data []byte) (*imageGrid, error) {
+	if len(data) < 8 {
+		return nil, fmt.Errorf("%w: grid data of %d bytes", ErrCorrupt, len(data))
+	}
+	g := &imageGrid{rows: int(data[2]) + 1, columns: int(data[3]) + 1}
+	if data[1]&1 == 0 {
+		g.width = int(binary.BigEndian.Uint16(data[4:]))
+		g.height = int(binary.BigEndian.Uint16(data[6:]))
+		return g, nil
+	}
+	if len(data) < 12 {
+		return nil, fmt.Errorf("%w: grid data of %d bytes", ErrCorrupt, len(data))
+	}
+	g.width = int(binary.BigEndian.Uint32(data[4:]))
+	g.height = int(binary.BigEndian.Uint32(data[8:]))
+	return g, nil
+}
+
+// Crop crops the primary image to rect, in the coordinates of the coded
+// image, before rotation and mirroring. The tiles of a grid image outside
+// rect are removed with their items, and the rest of the crop is done
+// by a clap property. The coded images are not changed. The thumbnails
+// of the image are removed, as they no longer match. With subsampled
+// chroma, the top left corner of rect is rounded down to the first pixel
+// of a chroma sample.
+func Crop(rect image.Rectangle) RewriteOption {
+	return func(r *rewrite) error {
+		id := uint32(r.meta.PrimaryItem.ItemID)
+		width, height, err := r.spatialExtents(id)
+		if err != nil {
+			return err
+		}
+		if rect = rect.Intersect(image.Rect(0, 0, width, height)); rect.Empty() {
+			return fmt.Errorf("heif: crop outside of the %dx%d image", width, height)
+		}
+		switch r.chromaFormat(id) {
+		case 1: // 4:2:0
+			rect.Min = image.Pt(rect.Min.X&^1, rect.Min.Y&^1)
+		case 2: // 4:2:2
+			rect.Min.X &^= 1
+		}
+		ent, err := r.associations(id)
+		if err != nil {
+			return err
+		}
+		for _, p := range ent.Associations {
+			if r.propertyType(p.Index) == "clap" {
+				return &ItemError{ItemID: id, Err: fmt.Errorf("%w: crop of a cropped image", ErrUnsupported)}
+			}
+		}
+
+		var typ string
+		for _, ife := range r.meta.ItemInfo.ItemInfos {
+			if uint32(ife.ItemID) == id {
+				typ = ife.ItemType
+			}
+		}
+		if typ == "grid" {
+			var origin image.Point
+			if width, height, origin, err = r.cropGrid(id, rect); err != nil {
+				return err
+			}
+			rect = rect.Sub(origin)
+			// the entries moved with those of the tiles removed
+			if ent, err = r.associations(id); err != nil {
+				return err
+			}
+		}
+
+		if rect != image.Rect(0, 0, width, height) {
+			idx, err := r.propertyIndex(bmff.NewCleanAperture(rect, width, height))
+			if err != nil {
+				return err
+			}
+			// before the rotation and mirroring
+			i := slices.IndexFunc(ent.Associations, func(p bmff.ItemProperty) bool {
+				typ := r.propertyType(p.Index)
+				return typ == "irot" || typ == "imir"
+			})
+			if i < 0 {
+				i = len(ent.Associations)
+			}
+			ent.Associations = slices.Insert(ent.Associations, i, bmff.ItemProperty{Essential: true, Index: idx})
+			ent.AssociationsCount = len(ent.Associations)
+		}
+
+		var thumbs []uint32
+		if r.meta.ItemReference != nil {
+			for _, ref := range r.meta.ItemReference.ItemRefs {
+				if ref.Type().String() == "thmb" && slices.Contains(ref.ToItemIDs, id) {
+					thumbs = append(thumbs, ref.FromItemID)
+				}
+			}
+		}
+		for _, thumb := range thumbs {
+			r.remove(thumb)
+		}
+		return nil
+	}
+}
+
+// chromaFormat returns the chroma_format_idc in the hvcC of an image, or
+// of the first tile of a grid image, assuming 4:2:0 if there is none.
+func (r *rewrite) chromaFormat(id uint32) uint8 {
+	if dimg := r.reference(id, "dimg"); dimg != nil && len(dimg.ToItemIDs) > 0 {
+		id = dimg.ToItemIDs[0]
+	}
+	if ent, err := r.associations(id); err == nil {
+		for _, a := range ent.Associations {
+			if hvcc, ok := r.property(a.Index).(*bmff.ItemHevcConfigBox); ok {
+				return hvcc.Config().ChromaFormat
+			}
+		}
+	}
+	return 1
+}
+
+// cropGrid keeps the tiles of a grid image that intersect rect, and
+// returns the new size of the grid and the position of its top-left
+// corner in the old one.
+func (r *rewrite) cropGrid(id uint32, rect image.Rectangle) (width, height int, origin image.Point, err error) {
+	fail := func(err error) (int, int, image.Point, error) {
+		return 0, 0, image.Point{}, &ItemError{ItemID: id, Err: err}
+	}
+	data, err := r.itemData(id)
+	if err != nil {
+		return 0, 0, image.Point{}, err
+	}
+	g, err := parseImageGrid(data)
+	if err != nil {
+		return fail(err)
+	}
+	dimg := r.reference(id, "dimg")
+	if dimg == nil || len(dimg.ToItemIDs) != g.rows*g.columns {
+		return fail(fmt.Errorf("%w: grid of %dx%d tiles without as many dimg references", ErrCorrupt, g.columns, g.rows))
+	}
+	tw, th, err := r.spatialExtents(dimg.ToItemIDs[0])
+	if err != nil {
+		return 0, 0, image.Point{}, err
+	}
+	if rect = rect.Intersect(image.Rect(0, 0, g.width, g.height)); rect.Empty() || tw <= 0 || th <= 0 {
+		return fail(fmt.Errorf("%w: grid of %dx%d tiles of %dx%d", ErrCorrupt, g.columns, g.rows, tw, th))
+	}
+
+	c0, c1 := rect.Min.X/tw, (rect.Max.X-1)/tw
+	r0, r1 := rect.Min.Y/th, (rect.Max.Y-1)/th
+	if c1 >= g.columns || r1 >= g.rows {
+		return fail(fmt.Errorf("%w: grid of %dx%d tiles of %dx%d smaller than %dx%d", ErrCorrupt, g.columns, g.rows, tw, th, g.width, g.height))
+	}
+	var keep, drop []uint32
+	for i, tile := range dimg.ToItemIDs {
+		if row, col := i/g.columns, i%g.columns; row >= r0 && row <= r1 && col >= c0 && col <= c1 {
+			keep = append(keep, tile)
+		} else {
+			drop = append(drop, tile)
+		}
+	}
+	dimg.ToItemIDs = keep
+	dimg.Count = uint16(len(keep))
+	for _, tile := range drop {
+		r.remove(tile)
+	}
+
+	origin = image.Pt(c0*tw, r0*th)
+	width = min(g.width, (c1+1)*tw) - origin.X
+	height = min(g.height, (r1+1)*th) - origin.Y
+	r.data[id] = gridData(r1-r0+1, c1-c0+1, width, height)
+
+	ent, err := r.associations(id)
+	if err != nil {
+		return 0, 0, image.Point{}, err
+	}
+	idx, err := r.propertyIndex(spatialExtents(width, height))
+	if err != nil {
+		return 0, 0, image.Point{}, err
+	}
+	for i, p := range ent.Associations {
+		if r.propertyType(p.Index) == "ispe" {
+			ent.Associations[i].Index = idx
+		}
+	}
+	return width, height, origin, nil
+}
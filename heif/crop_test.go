@@ -0,0 +1,158 @@
+package heif
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"os"
+	"slices"
+	"testing"
+
+	"github.com/jdeng/goheif/heif/bmff"
+)
+
+// clapBody returns the body of the clap property of an item, or nil.
+func clapBody(t *testing.T, it *Item) []byte {
+	t.Helper()
+	for _, p := range it.Properties {
+		if p.Type().String() != "clap" {
+			continue
+		}
+		data, err := bmff.Marshal(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data[8:]
+	}
+	return nil
+}
+
+func TestCrop(t *testing.T) {
+	f, err := os.Open("../testdata/camel.heic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	src := Open(f)
+	primary, err := src.PrimaryItem()
+	if err != nil {
+		t.Fatal(err)
+	}
+	img := testImage(t, src, primary)
+	thumb, err := src.ItemByID(primary.ID + 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a grid of 3x1 tiles, the last one cropped by 10 pixels
+	w := NewWriter()
+	gridID, err := w.AddGrid(&Grid{
+		Rows: 1, Columns: 3,
+		Width: 3*img.Width - 10, Height: img.Height,
+		Tiles:      []*Image{img, img, img},
+		Properties: []bmff.Box{bmff.NewImageRotation(1)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.AddThumbnail(gridID, testImage(t, src, thumb)); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if _, err := w.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	hf := Open(bytes.NewReader(buf.Bytes()))
+	grid, err := hf.PrimaryItem()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tiles := grid.Reference("dimg").ToItemIDs
+
+	for _, tt := range []struct {
+		rect          image.Rectangle
+		tiles         []uint32
+		width, height int
+		clap          []int32
+		clapRect      image.Rectangle // in the cropped grid
+	}{
+		// the last two tiles, to the edge of the image
+		{image.Rect(img.Width+4, 2, 3*img.Width, img.Height), tiles[1:], 2*img.Width - 10, img.Height,
+			[]int32{2*int32(img.Width) - 14, 1, int32(img.Height) - 2, 1, 4, 2, 2, 2}, image.Rect(4, 2, 2*img.Width-10, img.Height)},
+		// the same, from odd coordinates in 4:2:0
+		{image.Rect(img.Width+5, 3, 3*img.Width, img.Height), tiles[1:], 2*img.Width - 10, img.Height,
+			[]int32{2*int32(img.Width) - 14, 1, int32(img.Height) - 2, 1, 4, 2, 2, 2}, image.Rect(4, 2, 2*img.Width-10, img.Height)},
+		// the whole first tile
+		{image.Rect(0, 0, img.Width, img.Height), tiles[:1], img.Width, img.Height, nil, image.Rectangle{}},
+	} {
+		cropped := rewritten(t, hf, Crop(tt.rect))
+		it, err := cropped.PrimaryItem()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w, h, _ := it.SpatialExtents(); w != tt.width || h != tt.height {
+			t.Errorf("%v: grid size %dx%d; want %dx%d", tt.rect, w, h, tt.width, tt.height)
+		}
+		data, err := cropped.GetItemData(it)
+		if err != nil {
+			t.Fatal(err)
+		}
+		g, err := parseImageGrid(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if *g != (imageGrid{1, len(tt.tiles), tt.width, tt.height}) {
+			t.Errorf("%v: grid %+v", tt.rect, *g)
+		}
+		if dimg := it.Reference("dimg"); dimg == nil || !slices.Equal(dimg.ToItemIDs, tt.tiles) {
+			t.Errorf("%v: dimg reference %+v; want tiles %v", tt.rect, dimg, tt.tiles)
+		}
+		for _, id := range tiles {
+			tile, err := cropped.ItemByID(id)
+			if slices.Contains(tt.tiles, id) != (err == nil) {
+				t.Errorf("%v: tile %d: %v", tt.rect, id, err)
+			}
+			if err == nil && !bytes.Equal(testImage(t, cropped, tile).Data, img.Data) {
+				t.Errorf("%v: tile %d data differs", tt.rect, id)
+			}
+		}
+		if it.Rotations() != 1 {
+			t.Errorf("%v: rotation %d; want 1", tt.rect, it.Rotations())
+		}
+
+		var clap []int32
+		if body := clapBody(t, it); body != nil {
+			clap = make([]int32, len(body)/4)
+			binary.Read(bytes.NewReader(body), binary.BigEndian, clap)
+		}
+		if !slices.Equal(clap, tt.clap) {
+			t.Errorf("%v: clap %v; want %v", tt.rect, clap, tt.clap)
+		}
+		for _, p := range it.Properties {
+			if clap, ok := p.(*bmff.CleanAperture); ok {
+				if r, ok := clap.Rect(tt.width, tt.height); !ok || r != tt.clapRect {
+					t.Errorf("%v: clap.Rect = %v, %v; want %v", tt.rect, r, ok, tt.clapRect)
+				}
+			}
+		}
+		// clap before irot
+		var types []string
+		for _, p := range it.Properties {
+			types = append(types, p.Type().String())
+		}
+		if tt.clap != nil && !slices.Equal(types[len(types)-2:], []string{"clap", "irot"}) {
+			t.Errorf("%v: properties %q; want clap and irot last", tt.rect, types)
+		}
+
+		meta, _ := cropped.getMeta()
+		for _, ref := range meta.ItemReference.ItemRefs {
+			if ref.Type().String() == "thmb" {
+				t.Errorf("%v: thumbnail reference %+v left", tt.rect, ref)
+			}
+		}
+	}
+
+	if _, err := hf.Rewrite(&bytes.Buffer{}, Crop(image.Rect(-10, -10, 0, 0))); err == nil {
+		t.Errorf("crop outside of the image succeeded")
+	}
+}
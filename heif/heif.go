@@ -15,7 +15,8 @@ limitations under the License.
 */
 
 // Package heif reads HEIF containers, as found in Apple HEIC/HEVC images.
-// This package does not decode images; it only reads the metadata.
+// This package does not decode images; it only reads the metadata, and
+// writes containers for images coded elsewhere with Writer.
 //
 // This package is a work in progress and makes no API compatibility
 // promises.
@@ -25,7 +26,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"math"
 
 	"github.com/jdeng/goheif/heif/bmff"
 )
@@ -36,6 +37,8 @@ import (
 type File struct {
 	ra      io.ReaderAt
 	primary *Item
+	limits  Limits
+	used    int64 // bytes charged against limits.MaxTotalBytes
 
 	// Populated lazily, by getMeta:
 	metaErr error
@@ -52,6 +55,8 @@ type BoxMeta struct {
 	ItemLocation  *bmff.ItemLocationBox
 	ItemData      *bmff.ItemDataBox
 	ItemReference *bmff.ItemReferenceBox
+
+	box *bmff.MetaBox // holding the boxes above
 }
 
 // EXIFItemID returns the item ID of the EXIF part, or 0 if not found.
@@ -139,9 +144,74 @@ func (it *Item) VisualDimensions() (width, height int, ok bool) {
 	return
 }
 
+// Limits bounds the resources used while reading a file from untrusted
+// input. A zero field takes its value from DefaultLimits; a negative
+// field means no limit.
+type Limits struct {
+	MaxItemDataSize int64 // bytes of a single item returned by GetItemData
+	MaxTotalBytes   int64 // bytes of item data read plus those charged with Reserve
+	MaxBoxes        int   // number of boxes in the file's metadata
+
+	// MaxMetadataBytes bounds the box data held in memory while parsing
+	// the metadata, such as parameter sets and idat contents. Other
+	// boxes are read from the io.ReaderAt as needed.
+	MaxMetadataBytes int64
+}
+
+// DefaultLimits are the limits used by files opened without WithLimits,
+// and for the zero fields of the Limits passed to it.
+var DefaultLimits = Limits{
+	MaxItemDataSize:  200 << 20, // 200MB cap it for sanity
+	MaxMetadataBytes: 64 << 20,
+}
+
+func (l Limits) withDefaults() Limits {
+	if l.MaxItemDataSize == 0 {
+		l.MaxItemDataSize = DefaultLimits.MaxItemDataSize
+	}
+	if l.MaxTotalBytes == 0 {
+		l.MaxTotalBytes = DefaultLimits.MaxTotalBytes
+	}
+	if l.MaxBoxes == 0 {
+		l.MaxBoxes = DefaultLimits.MaxBoxes
+	}
+	if l.MaxMetadataBytes == 0 {
+		l.MaxMetadataBytes = DefaultLimits.MaxMetadataBytes
+	}
+	return l
+}
+
+// ErrLimitExceeded is returned when reading a file would exceed one of
+// its Limits. It is the same error as the one reported by package bmff.
+var ErrLimitExceeded = bmff.ErrLimitExceeded
+
+type Option func(*File)
+
+// WithLimits sets the resource limits used while reading the file.
+func WithLimits(l Limits) Option {
+	return func(f *File) {
+		f.limits = l.withDefaults()
+	}
+}
+
 // Open returns a handle to access a HEIF file.
-func Open(f io.ReaderAt) *File {
-	return &File{ra: f}
+func Open(f io.ReaderAt, opts ...Option) *File {
+	hf := &File{ra: f, limits: DefaultLimits}
+	for _, opt := range opts {
+		opt(hf)
+	}
+	return hf
+}
+
+// Reserve charges n bytes against the file's MaxTotalBytes limit. It lets
+// callers account for memory derived from the file, such as decoded
+// pixels, before allocating it. GetItemData reserves the item data itself.
+func (f *File) Reserve(n int64) error {
+	if max := f.limits.MaxTotalBytes; max > 0 && f.used+n > max {
+		return fmt.Errorf("heif: allocating %d more bytes exceeds the total of %d bytes: %w", n, max, ErrLimitExceeded)
+	}
+	f.used += n
+	return nil
 }
 
 // ErrNoEXIF is returned by File.EXIF when a file does not contain an EXIF item.
@@ -150,6 +220,28 @@ var ErrNoEXIF = errors.New("heif: no EXIF found")
 // ErrUnknownItem is returned by File.ItemByID for unknown items.
 var ErrUnknownItem = errors.New("heif: unknown item")
 
+// ErrCorrupt is wrapped by the errors for files that are truncated or
+// violate the HEIF structure. It is the same error as the one reported
+// by package bmff.
+var ErrCorrupt = bmff.ErrCorrupt
+
+// ErrUnsupported is wrapped by the errors for valid files using features
+// that this package does not implement. It is the same error as the one
+// reported by package bmff.
+var ErrUnsupported = bmff.ErrUnsupported
+
+// ItemError records an error and the item it occurred in.
+type ItemError struct {
+	ItemID uint32
+	Err    error
+}
+
+func (e *ItemError) Error() string {
+	return fmt.Sprintf("heif: item %d: %v", e.ItemID, e.Err)
+}
+
+func (e *ItemError) Unwrap() error { return e.Err }
+
 // EXIF returns the raw EXIF data from the file.
 // The error is ErrNoEXIF if the file did not contain EXIF.
 //
@@ -177,38 +269,68 @@ func (f *File) EXIF() ([]byte, error) {
 	return data[4:], nil // TODO: why 4? did I miss something?
 }
 
-// GetItemData returns data specified by item's location
+// GetItemData returns data specified by item's location.
+// Errors are reported as an *ItemError.
 func (f *File) GetItemData(it *Item) ([]byte, error) {
+	data, err := f.getItemData(it)
+	if err != nil {
+		return nil, &ItemError{ItemID: it.ID, Err: err}
+	}
+	return data, nil
+}
+
+func (f *File) getItemData(it *Item) ([]byte, error) {
 	loc := it.Location
 	if loc == nil {
-		return nil, errors.New("heif: item has no location")
+		return nil, fmt.Errorf("%w: item has no location", ErrCorrupt)
 	}
 	if n := len(loc.Extents); n != 1 {
-		return nil, fmt.Errorf("heif: expected 1 section, saw %d", n)
+		return nil, fmt.Errorf("%w: expected 1 section, saw %d", ErrUnsupported, n)
 	}
 	offLen := loc.Extents[0]
 
 	if loc.ConstructionMethod == 1 {
+		if err := f.checkItemDataSize(offLen.Length); err != nil {
+			return nil, err
+		}
 		if f.meta.ItemData == nil {
-			return nil, fmt.Errorf("heif: no idat for item")
+			return nil, fmt.Errorf("%w: no idat for item", ErrCorrupt)
 		}
 		if offLen.Offset+offLen.Length > uint64(len(f.meta.ItemData.Data)) {
-			return nil, fmt.Errorf("heif: idat out of bound")
+			return nil, fmt.Errorf("%w: idat out of bound", ErrCorrupt)
 		}
 		return f.meta.ItemData.Data[offLen.Offset : offLen.Offset+offLen.Length], nil
 	}
+	if loc.ConstructionMethod != 0 {
+		return nil, fmt.Errorf("%w: construction method %d", ErrUnsupported, loc.ConstructionMethod)
+	}
 
-	const maxSize = 200 << 20 // 200MB cap it for sanity
-	if offLen.Length > maxSize {
-		return nil, fmt.Errorf("heif: declared size %d exceeds threshold of %d bytes", offLen.Length, maxSize)
+	if err := f.checkItemDataSize(offLen.Length); err != nil {
+		return nil, err
+	}
+	if err := f.Reserve(int64(offLen.Length)); err != nil {
+		return nil, err
 	}
 	buf := make([]byte, offLen.Length)
 	n, err := f.ra.ReadAt(buf, int64(offLen.Offset+loc.BaseOffset))
-	if err != nil {
-		log.Printf("Read %d bytes (expected: %d from %d) + %v", n, offLen.Length, offLen.Offset+loc.BaseOffset, err)
-		return nil, err
+	if n == len(buf) {
+		return buf, nil
+	}
+	if err == nil || err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = ErrCorrupt
 	}
-	return buf, nil
+	return nil, fmt.Errorf("read %d bytes (expected: %d from %d): %w", n, offLen.Length, offLen.Offset+loc.BaseOffset, err)
+}
+
+// checkItemDataSize checks the declared size of an item against the limits.
+func (f *File) checkItemDataSize(size uint64) error {
+	if max := f.limits.MaxItemDataSize; max > 0 && size > uint64(max) {
+		return fmt.Errorf("heif: declared size %d exceeds threshold of %d bytes: %w", size, max, ErrLimitExceeded)
+	}
+	if size > math.MaxInt64 {
+		return fmt.Errorf("heif: declared size %d is too large: %w", size, ErrCorrupt)
+	}
+	return nil
 }
 
 func (f *File) setMetaErr(err error) error {
@@ -225,23 +347,38 @@ func (f *File) getMeta() (*BoxMeta, error) {
 	if f.meta != nil {
 		return f.meta, nil
 	}
-	const assumedMaxSize = 5 << 40 // arbitrary
-	sr := io.NewSectionReader(f.ra, 0, assumedMaxSize)
-	bmr := bmff.NewReader(sr)
+	meta, err := f.readMeta()
+	if err != nil {
+		return nil, f.setMetaErr(err)
+	}
+	f.meta = meta
+	return f.meta, nil
+}
+
+// readMeta parses the ftyp and meta boxes. Every call returns new boxes.
+func (f *File) readMeta() (*BoxMeta, error) {
+	bmr := bmff.NewReaderAt(f.ra)
+	if f.limits.MaxBoxes > 0 || f.limits.MaxMetadataBytes > 0 {
+		bmr.SetLimits(bmff.Limits{
+			MaxBoxes:         f.limits.MaxBoxes,
+			MaxMetadataBytes: f.limits.MaxMetadataBytes,
+		})
+	}
 
 	meta := &BoxMeta{}
 
 	pbox, err := bmr.ReadAndParseBox(bmff.TypeFtyp)
 	if err != nil {
-		return nil, f.setMetaErr(err)
+		return nil, err
 	}
 	meta.FileType = pbox.(*bmff.FileTypeBox)
 
 	pbox, err = bmr.ReadAndParseBox(bmff.TypeMeta)
 	if err != nil {
-		return nil, f.setMetaErr(err)
+		return nil, err
 	}
 	metabox := pbox.(*bmff.MetaBox)
+	meta.box = metabox
 
 	for _, box := range metabox.Children {
 		boxp, err := box.Parse()
@@ -249,7 +386,7 @@ func (f *File) getMeta() (*BoxMeta, error) {
 			continue
 		}
 		if err != nil {
-			return nil, f.setMetaErr(err)
+			return nil, err
 		}
 		switch v := boxp.(type) {
 		case *bmff.HandlerBox:
@@ -269,8 +406,7 @@ func (f *File) getMeta() (*BoxMeta, error) {
 		}
 	}
 
-	f.meta = meta
-	return f.meta, nil
+	return meta, nil
 }
 
 // PrimaryItem returns the HEIF file's primary item.
@@ -280,13 +416,14 @@ func (f *File) PrimaryItem() (*Item, error) {
 		return nil, err
 	}
 	if meta.PrimaryItem == nil {
-		return nil, errors.New("heif: HEIF file lacks primary item box")
+		return nil, fmt.Errorf("%w: HEIF file lacks primary item box", ErrCorrupt)
 	}
 	return f.ItemByID(uint32(meta.PrimaryItem.ItemID))
 }
 
 // ItemByID by returns the file's Item of a given ID.
-// If the ID is known, the returned error is ErrUnknownItem.
+// If the ID is unknown, the returned error is an *ItemError wrapping
+// ErrUnknownItem.
 func (f *File) ItemByID(id uint32) (*Item, error) {
 	meta, err := f.getMeta()
 	if err != nil {
@@ -321,7 +458,7 @@ func (f *File) ItemByID(id uint32) (*Item, error) {
 		}
 	}
 	if it.Info == nil {
-		return nil, ErrUnknownItem
+		return nil, &ItemError{ItemID: id, Err: ErrUnknownItem}
 	}
 	if meta.Properties != nil {
 		allProps := meta.Properties.PropertyContainer.Properties
@@ -345,6 +482,9 @@ func (f *File) ItemByID(id uint32) (*Item, error) {
 					if ass.Index != 0 && int(ass.Index) <= len(allProps) {
 						box := allProps[ass.Index-1]
 						boxp, err := box.Parse()
+						if errors.Is(err, ErrLimitExceeded) {
+							return nil, &ItemError{ItemID: id, Err: err}
+						}
 						if err == nil {
 							box = boxp
 						}
@@ -2,10 +2,16 @@ package heif
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"math"
 	"os"
+	"sync"
 	"testing"
 
+	"github.com/jdeng/goheif/heif/bmff"
+
 	"github.com/rwcarlsen/goexif/exif"
 	"github.com/rwcarlsen/goexif/tiff"
 )
@@ -106,6 +112,136 @@ func TestRotations(t *testing.T) {
 	}
 }
 
+// pixelInformation is a "pixi" property, parsed by a registered parser.
+type pixelInformation struct {
+	bmff.FullBox
+	BitsPerChannel []uint8
+}
+
+var registerPixi sync.Once
+
+func TestRegisterParser(t *testing.T) {
+	registerPixi.Do(func() { bmff.RegisterParser(bmff.BoxType{'p', 'i', 'x', 'i'}, parsePixelInformation) })
+
+	f, err := os.Open("testdata/park.heic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	it, err := Open(f).PrimaryItem()
+	if err != nil {
+		t.Fatalf("PrimaryItem: %v", err)
+	}
+	for _, p := range it.Properties {
+		if pixi, ok := p.(*pixelInformation); ok {
+			if !bytes.Equal(pixi.BitsPerChannel, []byte{8, 8, 8}) {
+				t.Errorf("pixi bits per channel = %v; want [8 8 8]", pixi.BitsPerChannel)
+			}
+			return
+		}
+	}
+	t.Errorf("no parsed pixi property in %v", it.Properties)
+}
+
+func parsePixelInformation(br *bmff.BoxReader) (bmff.Box, error) {
+	fb, err := br.ReadFullBoxHeader()
+	if err != nil {
+		return nil, err
+	}
+	n, err := br.ReadUint8()
+	if err != nil {
+		return nil, err
+	}
+	bits, err := br.ReadBytes(int(n))
+	if err != nil {
+		return nil, err
+	}
+	return &pixelInformation{FullBox: fb, BitsPerChannel: bits}, nil
+}
+
+func TestLimits(t *testing.T) {
+	f, err := os.Open("testdata/park.heic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	h := Open(f, WithLimits(Limits{MaxBoxes: 10}))
+	if _, err := h.PrimaryItem(); !errors.Is(err, ErrLimitExceeded) {
+		t.Errorf("PrimaryItem with MaxBoxes = %v; want ErrLimitExceeded", err)
+	}
+
+	// the tiles' hvcC parameter sets are larger than 16 bytes
+	h = Open(f, WithLimits(Limits{MaxMetadataBytes: 16}))
+	if _, err := h.ItemByID(1); !errors.Is(err, ErrLimitExceeded) {
+		t.Errorf("ItemByID with MaxMetadataBytes = %v; want ErrLimitExceeded", err)
+	}
+
+	h = Open(f, WithLimits(Limits{MaxItemDataSize: 100}))
+	it, err := h.PrimaryItem()
+	if err != nil {
+		t.Fatalf("PrimaryItem: %v", err)
+	}
+	dimg := it.Reference("dimg")
+	if dimg == nil {
+		t.Fatalf("expected a grid image")
+	}
+	tile, err := h.ItemByID(dimg.ToItemIDs[0])
+	if err != nil {
+		t.Fatalf("ItemByID: %v", err)
+	}
+	if _, err := h.GetItemData(tile); !errors.Is(err, ErrLimitExceeded) {
+		t.Errorf("GetItemData with MaxItemDataSize = %v; want ErrLimitExceeded", err)
+	}
+
+	// a size no file can have, without a limit
+	tile.Location.Extents[0].Length = math.MaxUint64
+	_, err = Open(f, WithLimits(Limits{MaxItemDataSize: -1})).GetItemData(tile)
+	var ie *ItemError
+	if !errors.Is(err, ErrCorrupt) || !errors.As(err, &ie) || ie.ItemID != tile.ID {
+		t.Errorf("GetItemData of %d bytes = %v; want an *ItemError wrapping ErrCorrupt", uint64(math.MaxUint64), err)
+	}
+
+	h = Open(f, WithLimits(Limits{MaxTotalBytes: 1 << 20}))
+	if err := h.Reserve(1 << 19); err != nil {
+		t.Errorf("Reserve: %v", err)
+	}
+	if err := h.Reserve(1 << 19); err != nil {
+		t.Errorf("Reserve: %v", err)
+	}
+	if err := h.Reserve(1); !errors.Is(err, ErrLimitExceeded) {
+		t.Errorf("Reserve over MaxTotalBytes = %v; want ErrLimitExceeded", err)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	b, err := ioutil.ReadFile("testdata/park.heic")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := Open(bytes.NewReader(b))
+	_, err = h.ItemByID(12345)
+	var ie *ItemError
+	if !errors.Is(err, ErrUnknownItem) || !errors.As(err, &ie) || ie.ItemID != 12345 {
+		t.Errorf("ItemByID(12345) = %v; want an *ItemError wrapping ErrUnknownItem", err)
+	}
+
+	// cut the file in the middle of the iprp box
+	h = Open(bytes.NewReader(b[:2000]))
+	_, err = h.PrimaryItem()
+	if !errors.Is(err, ErrCorrupt) {
+		t.Errorf("PrimaryItem of truncated file = %v; want ErrCorrupt", err)
+	}
+	var be *bmff.BoxError
+	if !errors.As(err, &be) {
+		t.Fatalf("PrimaryItem of truncated file = %v; want a *bmff.BoxError", err)
+	}
+	if be.Offset <= 0 || be.Offset >= 2000 || !bytes.Equal(b[be.Offset+4:be.Offset+8], be.Type[:]) {
+		t.Errorf("BoxError for %q has offset %d; want the offset of its header", be.Type, be.Offset)
+	}
+}
+
 type walkFunc func(exif.FieldName, *tiff.Tag) error
 
 func (f walkFunc) Walk(name exif.FieldName, tag *tiff.Tag) error {
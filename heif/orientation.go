@@ -0,0 +1,120 @@
+package heif
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/jdeng/goheif/heif/bmff"
+)
+
+// orientations holds the irot angle and imir axis, or -1 for none, of
+// the EXIF orientations 1 to 8. The rotation is applied first.
+var orientations = [9]struct{ angle, axis int8 }{
+	1: {0, -1},
+	2: {0, int8(bmff.MirrorVertical)},
+	3: {2, -1},
+	4: {0, int8(bmff.MirrorHorizontal)},
+	5: {3, int8(bmff.MirrorVertical)},
+	6: {3, -1},
+	7: {1, int8(bmff.MirrorVertical)},
+	8: {1, -1},
+}
+
+// SetOrientation sets the orientation of the primary image to one of
+// the EXIF orientations 1 to 8, where 1 shows the coded image as is and
+// 6 turns it 90 degrees clockwise. It replaces the irot and imir
+// properties of the image, and the orientation tag of the EXIF metadata
+// if there is one, as set by the options before it.
+func SetOrientation(orientation int) RewriteOption {
+	return func(r *rewrite) error {
+		if orientation < 1 || orientation > 8 {
+			return fmt.Errorf("heif: EXIF orientation %d", orientation)
+		}
+		o := orientations[orientation]
+		ent, err := r.associations(uint32(r.meta.PrimaryItem.ItemID))
+		if err != nil {
+			return err
+		}
+		ent.Associations = filter(ent.Associations, func(p bmff.ItemProperty) bool {
+			typ := r.propertyType(p.Index)
+			return typ != "irot" && typ != "imir"
+		})
+
+		var props []bmff.Box
+		if o.angle != 0 {
+			props = append(props, bmff.NewImageRotation(uint8(o.angle)))
+		}
+		if o.axis >= 0 {
+			props = append(props, bmff.NewImageMirror(uint8(o.axis)))
+		}
+		for _, p := range props {
+			idx, err := r.propertyIndex(p)
+			if err != nil {
+				return err
+			}
+			ent.Associations = append(ent.Associations, bmff.ItemProperty{Essential: true, Index: idx})
+		}
+		ent.AssociationsCount = len(ent.Associations)
+		return r.setEXIFOrientation(uint16(orientation))
+	}
+}
+
+// setEXIFOrientation sets the orientation tag of the EXIF metadata, if
+// the file has both.
+func (r *rewrite) setEXIFOrientation(orientation uint16) error {
+	id := r.meta.EXIFItemID()
+	if id == 0 {
+		return nil
+	}
+	data, err := r.itemData(id)
+	if err != nil {
+		return err
+	}
+	if len(data) < 4 {
+		return &ItemError{ItemID: id, Err: fmt.Errorf("%w: EXIF item of %d bytes", ErrCorrupt, len(data))}
+	}
+	// after the offset of the TIFF header
+	off := 4 + int(binary.BigEndian.Uint32(data))
+	if off < 4 || off > len(data) {
+		return &ItemError{ItemID: id, Err: fmt.Errorf("%w: TIFF header at %d", ErrCorrupt, off)}
+	}
+	data = append([]byte(nil), data...)
+	if setTIFFOrientation(data[off:], orientation) {
+		r.data[id] = data
+	}
+	return nil
+}
+
+// setTIFFOrientation sets the orientation tag of the first IFD of the
+// TIFF data, in place. It reports whether the tag was found.
+func setTIFFOrientation(tiff []byte, orientation uint16) bool {
+	if len(tiff) < 8 {
+		return false
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return false
+	}
+	ifd := uint64(order.Uint32(tiff[4:]))
+	if ifd+2 > uint64(len(tiff)) {
+		return false
+	}
+	n := uint64(order.Uint16(tiff[ifd:]))
+	for i := uint64(0); i < n; i++ {
+		ent := ifd + 2 + 12*i
+		if ent+12 > uint64(len(tiff)) {
+			return false
+		}
+		const tagOrientation, typeShort = 0x0112, 3
+		if order.Uint16(tiff[ent:]) == tagOrientation && order.Uint16(tiff[ent+2:]) == typeShort && order.Uint32(tiff[ent+4:]) == 1 {
+			order.PutUint16(tiff[ent+8:], orientation)
+			return true
+		}
+	}
+	return false
+}
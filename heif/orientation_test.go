@@ -0,0 +1,65 @@
+package heif
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/jdeng/goheif/heif/bmff"
+)
+
+func TestSetOrientation(t *testing.T) {
+	f, err := os.Open("../testdata/camel.heic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	src := Open(f)
+	want := primaryData(t, src)
+	// a TIFF header and an IFD with an orientation tag of 1
+	exif := []byte("Exif\x00\x00MM\x00\x2a\x00\x00\x00\x08\x00\x01\x01\x12\x00\x03\x00\x00\x00\x01\x00\x01\x00\x00\x00\x00\x00\x00")
+
+	hf := rewritten(t, src, SetEXIF(exif))
+	for _, tt := range []struct {
+		orientation  int
+		angle, axis  int
+		hasMirroring bool
+	}{
+		{6, 3, 0, false},
+		{7, 1, int(bmff.MirrorVertical), true},
+		{4, 0, int(bmff.MirrorHorizontal), true},
+		{1, 0, 0, false},
+	} {
+		hf = rewritten(t, hf, SetOrientation(tt.orientation))
+		it, err := hf.PrimaryItem()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var rotations, mirrors int
+		for _, p := range it.Properties {
+			switch p.(type) {
+			case *bmff.ImageRotation:
+				rotations++
+			case *bmff.ImageMirror:
+				mirrors++
+			}
+		}
+		if rotations > 1 || mirrors > 1 || it.Rotations() != tt.angle || it.Mirror() != tt.axis || (mirrors == 1) != tt.hasMirroring {
+			t.Errorf("orientation %d: %d irot of angle %d, %d imir of axis %d; want angle %d, axis %d", tt.orientation, rotations, it.Rotations(), mirrors, it.Mirror(), tt.angle, tt.axis)
+		}
+		got, err := hf.EXIF()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if o := got[len(got)-7]; len(got) != len(exif) || o != byte(tt.orientation) {
+			t.Errorf("orientation %d: EXIF orientation %d", tt.orientation, o)
+		}
+		if !bytes.Equal(primaryData(t, hf), want) {
+			t.Errorf("orientation %d: primary item data differs", tt.orientation)
+		}
+	}
+
+	if _, err := src.Rewrite(&bytes.Buffer{}, SetOrientation(9)); err == nil {
+		t.Errorf("SetOrientation(9) succeeded")
+	}
+}
@@ -0,0 +1,366 @@
+package heif
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/jdeng/goheif/heif/bmff"
+)
+
+// xmpContentType is the content type of the "mime" items of XMP packets.
+const xmpContentType = "application/rdf+xml"
+
+func isEXIF(ife *bmff.ItemInfoEntry) bool { return ife.ItemType == "Exif" }
+
+func isXMP(ife *bmff.ItemInfoEntry) bool {
+	return ife.ItemType == "mime" && ife.ContentType == xmpContentType
+}
+
+// A RewriteOption changes the file written by File.Rewrite.
+type RewriteOption func(*rewrite) error
+
+type rewrite struct {
+	f    *File
+	meta *BoxMeta
+	data map[uint32][]byte // new data of items
+}
+
+// SetEXIF replaces the EXIF metadata of the file, or adds it to the
+// primary item. The data is as returned by File.EXIF.
+func SetEXIF(exif []byte) RewriteOption {
+	return func(r *rewrite) error { return r.set(isEXIF, exifItem(exif)) }
+}
+
+// RemoveEXIF removes the EXIF metadata of the file.
+func RemoveEXIF() RewriteOption {
+	return func(r *rewrite) error { return r.set(isEXIF, nil) }
+}
+
+// SetXMP replaces the XMP packet of the file, or adds it to the primary
+// item.
+func SetXMP(xmp []byte) RewriteOption {
+	return func(r *rewrite) error { return r.set(isXMP, xmpItem(xmp)) }
+}
+
+// RemoveXMP removes the XMP packets of the file.
+func RemoveXMP() RewriteOption {
+	return func(r *rewrite) error { return r.set(isXMP, nil) }
+}
+
+// Rewrite writes the file to w, changed by the options, and returns the
+// number of bytes written. The coded images and other items are copied
+// unchanged; only the ftyp and meta boxes are kept, followed by an mdat
+// box with the data of the items stored in the file.
+func (f *File) Rewrite(w io.Writer, opts ...RewriteOption) (int64, error) {
+	// The boxes are changed, so they must not be those of f.meta.
+	meta, err := f.readMeta()
+	if err != nil {
+		return 0, err
+	}
+	if meta.ItemInfo == nil || meta.ItemLocation == nil || meta.PrimaryItem == nil {
+		return 0, fmt.Errorf("%w: HEIF file lacks iinf, iloc or pitm box", ErrCorrupt)
+	}
+	r := &rewrite{f: f, meta: meta, data: map[uint32][]byte{}}
+	for _, opt := range opts {
+		if err := opt(r); err != nil {
+			return 0, err
+		}
+	}
+	chunks, err := r.chunks()
+	if err != nil {
+		return 0, err
+	}
+	return writeFile(w, meta.FileType, meta.box, chunks)
+}
+
+// set replaces the data of the first item matching the filter with that
+// of it, or adds it if there is none, and removes the other items
+// matching the filter. A nil it removes them all.
+func (r *rewrite) set(match func(*bmff.ItemInfoEntry) bool, it *writerItem) error {
+	var ids []uint32
+	for _, ife := range r.meta.ItemInfo.ItemInfos {
+		if match(ife) {
+			ids = append(ids, uint32(ife.ItemID))
+		}
+	}
+	if it != nil && len(ids) > 0 {
+		r.data[ids[0]] = it.data
+		ids = ids[1:]
+	} else if it != nil {
+		if err := r.add(it); err != nil {
+			return err
+		}
+	}
+	for _, id := range ids {
+		r.remove(id)
+	}
+	return nil
+}
+
+// add adds a metadata item describing the primary item.
+func (r *rewrite) add(it *writerItem) error {
+	meta := r.meta
+	var maxID uint16
+	for _, ife := range meta.ItemInfo.ItemInfos {
+		maxID = max(maxID, ife.ItemID)
+	}
+	if maxID == math.MaxUint16 {
+		return fmt.Errorf("heif: more than %d items", math.MaxUint16)
+	}
+	id := maxID + 1
+	meta.ItemInfo.ItemInfos = append(meta.ItemInfo.ItemInfos, &bmff.ItemInfoEntry{
+		FullBox:     bmff.NewFullBox(bmff.TypeInfe, 2, 0),
+		ItemID:      id,
+		ItemType:    it.typ,
+		ContentType: it.contentType,
+	})
+	meta.ItemInfo.Count = uint32(len(meta.ItemInfo.ItemInfos))
+	meta.ItemLocation.Items = append(meta.ItemLocation.Items, bmff.ItemLocationBoxEntry{ItemID: id})
+	meta.ItemLocation.ItemCount = uint16(len(meta.ItemLocation.Items))
+	r.data[uint32(id)] = it.data
+
+	if meta.ItemReference == nil {
+		meta.ItemReference = &bmff.ItemReferenceBox{FullBox: bmff.NewFullBox(bmff.TypeIref, 0, 0)}
+		// before the iprp box, as in the files of Writer
+		children := meta.box.Children
+		i := len(children)
+		for j, b := range children {
+			if b.Type() == (bmff.BoxType{'i', 'p', 'r', 'p'}) {
+				i = j
+				break
+			}
+		}
+		meta.box.Children = append(children[:i:i], append([]bmff.Box{meta.ItemReference}, children[i:]...)...)
+	}
+	meta.ItemReference.ItemRefs = append(meta.ItemReference.ItemRefs,
+		bmff.NewItemReferenceEntry(bmff.BoxType{'c', 'd', 's', 'c'}, uint32(id), uint32(meta.PrimaryItem.ItemID)))
+	return nil
+}
+
+// remove removes an item, its location, properties and the references
+// from and to it.
+func (r *rewrite) remove(id uint32) {
+	meta := r.meta
+	delete(r.data, id)
+
+	iinf := meta.ItemInfo
+	iinf.ItemInfos = filter(iinf.ItemInfos, func(ife *bmff.ItemInfoEntry) bool { return uint32(ife.ItemID) != id })
+	iinf.Count = uint32(len(iinf.ItemInfos))
+
+	iloc := meta.ItemLocation
+	iloc.Items = filter(iloc.Items, func(ent bmff.ItemLocationBoxEntry) bool { return uint32(ent.ItemID) != id })
+	iloc.ItemCount = uint16(len(iloc.Items))
+
+	if iref := meta.ItemReference; iref != nil {
+		iref.ItemRefs = filter(iref.ItemRefs, func(ref *bmff.ItemReferenceEntry) bool {
+			if ref.FromItemID == id {
+				return false
+			}
+			ref.ToItemIDs = filter(ref.ToItemIDs, func(to uint32) bool { return to != id })
+			ref.Count = uint16(len(ref.ToItemIDs))
+			return len(ref.ToItemIDs) > 0
+		})
+	}
+
+	if meta.Properties != nil {
+		for _, ipma := range meta.Properties.Associations {
+			ipma.Entries = filter(ipma.Entries, func(e bmff.ItemPropertyAssociationItem) bool { return e.ItemID != id })
+			ipma.EntryCount = uint32(len(ipma.Entries))
+		}
+	}
+}
+
+// itemData returns the data of an item, as set by the options before.
+func (r *rewrite) itemData(id uint32) ([]byte, error) {
+	if data, ok := r.data[id]; ok {
+		return data, nil
+	}
+	it, err := r.f.ItemByID(id)
+	if err != nil {
+		return nil, err
+	}
+	return r.f.GetItemData(it)
+}
+
+// reference returns the reference of the given type from an item, or nil.
+func (r *rewrite) reference(from uint32, typ string) *bmff.ItemReferenceEntry {
+	if r.meta.ItemReference == nil {
+		return nil
+	}
+	for _, ref := range r.meta.ItemReference.ItemRefs {
+		if ref.FromItemID == from && ref.Type().String() == typ {
+			return ref
+		}
+	}
+	return nil
+}
+
+// associations returns the property associations of an item, adding an
+// entry for it if there is none. Callers changing the associations must
+// update AssociationsCount. The entry moves when items are removed.
+func (r *rewrite) associations(id uint32) (*bmff.ItemPropertyAssociationItem, error) {
+	if r.meta.Properties == nil || len(r.meta.Properties.Associations) == 0 {
+		return nil, fmt.Errorf("%w: HEIF file lacks iprp box", ErrCorrupt)
+	}
+	for _, ipma := range r.meta.Properties.Associations {
+		for i := range ipma.Entries {
+			if ipma.Entries[i].ItemID == id {
+				return &ipma.Entries[i], nil
+			}
+		}
+	}
+	ipma := r.meta.Properties.Associations[0]
+	ipma.Entries = append(ipma.Entries, bmff.ItemPropertyAssociationItem{ItemID: id})
+	ipma.EntryCount = uint32(len(ipma.Entries))
+	return &ipma.Entries[len(ipma.Entries)-1], nil
+}
+
+// propertyIndex returns the index in the ipco box of a property of the
+// same encoding as p, adding p if there is none.
+func (r *rewrite) propertyIndex(p bmff.Box) (uint16, error) {
+	enc, err := bmff.Marshal(p)
+	if err != nil {
+		return 0, err
+	}
+	ipco := r.meta.Properties.PropertyContainer
+	for i, q := range ipco.Properties {
+		if q.Type() != p.Type() {
+			continue
+		}
+		if qenc, err := bmff.Marshal(q); err == nil && string(qenc) == string(enc) {
+			return uint16(i + 1), nil
+		}
+	}
+	ipco.Properties = append(ipco.Properties, p)
+	return uint16(len(ipco.Properties)), nil
+}
+
+// property returns the property of the given index in the ipco box,
+// parsed if possible, or nil if there is none.
+func (r *rewrite) property(index uint16) bmff.Box {
+	props := r.meta.Properties.PropertyContainer.Properties
+	if index == 0 || int(index) > len(props) {
+		return nil
+	}
+	p := props[index-1]
+	if _, ok := p.(bmff.Marshaler); !ok {
+		if pb, err := p.Parse(); err == nil {
+			return pb
+		}
+	}
+	return p
+}
+
+// propertyType returns the type of the property of the given index in
+// the ipco box, or "" if there is none.
+func (r *rewrite) propertyType(index uint16) string {
+	if p := r.property(index); p != nil {
+		return p.Type().String()
+	}
+	return ""
+}
+
+// spatialExtents returns the size of an image in its ispe property.
+func (r *rewrite) spatialExtents(id uint32) (width, height int, err error) {
+	ent, err := r.associations(id)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, a := range ent.Associations {
+		if ispe, ok := r.property(a.Index).(*bmff.ImageSpatialExtentsProperty); ok {
+			return int(ispe.ImageWidth), int(ispe.ImageHeight), nil
+		}
+	}
+	return 0, 0, &ItemError{ItemID: id, Err: fmt.Errorf("%w: no ispe", ErrCorrupt)}
+}
+
+// filter returns the elements of s for which keep returns true, reusing
+// the array of s.
+func filter[T any](s []T, keep func(T) bool) []T {
+	out := s[:0]
+	for _, v := range s {
+		if keep(v) {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// chunks returns the data of the items to write in the mdat box: the new
+// data of items, and the data stored in the file outside the meta box.
+// The locations of those items are changed to point to the offsets set
+// by writeFile. The idat box is rebuilt with the data of the items left
+// in it, or removed if there are none. Items in other files are
+// unchanged.
+func (r *rewrite) chunks() ([]mdatChunk, error) {
+	var chunks []mdatChunk
+	var idat []byte
+	items := r.meta.ItemLocation.Items
+	for i := range items {
+		ent := &items[i]
+		if data, ok := r.data[uint32(ent.ItemID)]; ok {
+			ent.ConstructionMethod = 0
+			ent.DataReferenceIndex = 0
+			ent.BaseOffset = 0
+			ent.ExtentCount = 1
+			ent.Extents = []bmff.OffsetLength{{Length: uint64(len(data))}}
+			chunks = append(chunks, mdatChunk{&ent.Extents[0], bytes.NewReader(data), int64(len(data))})
+			continue
+		}
+		if ent.ConstructionMethod == 1 {
+			var err error
+			if idat, err = r.appendIdat(idat, ent); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if ent.ConstructionMethod != 0 || ent.DataReferenceIndex != 0 {
+			continue
+		}
+		for j := range ent.Extents {
+			ext := &ent.Extents[j]
+			if ext.Length == 0 {
+				return nil, &ItemError{ItemID: uint32(ent.ItemID), Err: fmt.Errorf("%w: extent to the end of the file", ErrUnsupported)}
+			}
+			off := ent.BaseOffset + ext.Offset
+			if off < ent.BaseOffset || off > math.MaxInt64 || ext.Length > math.MaxInt64-off {
+				return nil, &ItemError{ItemID: uint32(ent.ItemID), Err: fmt.Errorf("%w: extent of %d bytes at %d", ErrCorrupt, ext.Length, off)}
+			}
+			chunks = append(chunks, mdatChunk{ext, io.NewSectionReader(r.f.ra, int64(off), int64(ext.Length)), int64(ext.Length)})
+		}
+		ent.BaseOffset = 0
+	}
+	if idb := r.meta.ItemData; idb != nil && len(idat) > 0 {
+		idb.Data = idat
+	} else if idb != nil {
+		r.meta.box.Children = filter(r.meta.box.Children, func(b bmff.Box) bool { return b.Type() != bmff.TypeIdat })
+		r.meta.ItemData = nil
+	}
+	return chunks, nil
+}
+
+// appendIdat appends the data of an item in the idat box to idat, and
+// changes the location of the item to point there.
+func (r *rewrite) appendIdat(idat []byte, ent *bmff.ItemLocationBoxEntry) ([]byte, error) {
+	if r.meta.ItemData == nil {
+		return nil, &ItemError{ItemID: uint32(ent.ItemID), Err: fmt.Errorf("%w: no idat for item", ErrCorrupt)}
+	}
+	data := r.meta.ItemData.Data
+	for j := range ent.Extents {
+		ext := &ent.Extents[j]
+		start := ent.BaseOffset + ext.Offset
+		end := start + ext.Length
+		if ext.Length == 0 {
+			end = uint64(len(data)) // to the end of the idat box
+		}
+		if start < ent.BaseOffset || end < start || end > uint64(len(data)) {
+			return nil, &ItemError{ItemID: uint32(ent.ItemID), Err: fmt.Errorf("%w: extent of %d bytes at %d outside of the idat box", ErrCorrupt, ext.Length, start)}
+		}
+		ext.Offset, ext.Length = uint64(len(idat)), end-start
+		idat = append(idat, data[start:end]...)
+	}
+	ent.BaseOffset = 0
+	return idat, nil
+}
@@ -0,0 +1,201 @@
+package heif
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/jdeng/goheif/heif/bmff"
+)
+
+// rewritten returns the file f rewritten with the options.
+func rewritten(t *testing.T, f *File, opts ...RewriteOption) *File {
+	t.Helper()
+	var buf bytes.Buffer
+	n, err := f.Rewrite(&buf, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(buf.Len()) {
+		t.Errorf("Rewrite = %d; wrote %d bytes", n, buf.Len())
+	}
+	return Open(bytes.NewReader(buf.Bytes()))
+}
+
+// xmpItems returns the data of the XMP items of f.
+func xmpItems(t *testing.T, f *File) [][]byte {
+	t.Helper()
+	meta, err := f.getMeta()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var xmps [][]byte
+	for _, ife := range meta.ItemInfo.ItemInfos {
+		if !isXMP(ife) {
+			continue
+		}
+		it, err := f.ItemByID(uint32(ife.ItemID))
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := f.GetItemData(it)
+		if err != nil {
+			t.Fatal(err)
+		}
+		xmps = append(xmps, data)
+	}
+	return xmps
+}
+
+// primaryData returns the data of the primary item of f.
+func primaryData(t *testing.T, f *File) []byte {
+	t.Helper()
+	it, err := f.PrimaryItem()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := f.GetItemData(it)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestRewrite(t *testing.T) {
+	f, err := os.Open("../testdata/camel.heic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	src := Open(f)
+	if _, err := src.EXIF(); !errors.Is(err, ErrNoEXIF) {
+		t.Fatalf("test file has EXIF: %v", err)
+	}
+	want := primaryData(t, src)
+	exif := append([]byte("Exif\x00\x00MM\x00\x2a\x00\x00\x00\x08"), make([]byte, 6)...)
+	xmp := []byte(`<x:xmpmeta xmlns:x="adobe:ns:meta/"/>`)
+
+	added := rewritten(t, src, SetEXIF(exif), SetXMP(xmp))
+	if got, err := added.EXIF(); err != nil || !bytes.Equal(got, exif) {
+		t.Errorf("EXIF = %q, %v; want %q", got, err, exif)
+	}
+	if got := xmpItems(t, added); len(got) != 1 || !bytes.Equal(got[0], xmp) {
+		t.Errorf("XMP items %q; want %q", got, xmp)
+	}
+	primary, err := added.PrimaryItem()
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, _ := added.getMeta()
+	exifItem, err := added.ItemByID(meta.EXIFItemID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cdsc := exifItem.Reference("cdsc"); cdsc == nil || len(cdsc.ToItemIDs) != 1 || cdsc.ToItemIDs[0] != primary.ID {
+		t.Errorf("cdsc reference %+v; want one to %d", cdsc, primary.ID)
+	}
+	if !bytes.Equal(primaryData(t, added), want) {
+		t.Errorf("primary item data differs")
+	}
+
+	exif2 := append([]byte("II\x2a\x00\x08\x00\x00\x00"), make([]byte, 6)...)
+	replaced := rewritten(t, added, SetEXIF(exif2), RemoveXMP())
+	if got, err := replaced.EXIF(); err != nil || !bytes.Equal(got, exif2) {
+		t.Errorf("EXIF = %q, %v; want %q", got, err, exif2)
+	}
+	if got := xmpItems(t, replaced); len(got) != 0 {
+		t.Errorf("XMP items %q after RemoveXMP", got)
+	}
+
+	removed := rewritten(t, replaced, RemoveEXIF())
+	if _, err := removed.EXIF(); !errors.Is(err, ErrNoEXIF) {
+		t.Errorf("EXIF after RemoveEXIF: %v; want ErrNoEXIF", err)
+	}
+	if !bytes.Equal(primaryData(t, removed), want) {
+		t.Errorf("primary item data differs")
+	}
+	meta, _ = removed.getMeta()
+	for _, ref := range meta.ItemReference.ItemRefs {
+		if ref.Type().String() == "cdsc" {
+			t.Errorf("cdsc reference %+v left", ref)
+		}
+	}
+}
+
+// toIdat moves the data of the EXIF and XMP items into an idat box.
+func toIdat(r *rewrite) error {
+	idat := &bmff.ItemDataBox{FullBox: bmff.NewFullBox(bmff.TypeIdat, 0, 0)}
+	for _, ife := range r.meta.ItemInfo.ItemInfos {
+		if !isEXIF(ife) && !isXMP(ife) {
+			continue
+		}
+		id := uint32(ife.ItemID)
+		data, err := r.itemData(id)
+		if err != nil {
+			return err
+		}
+		delete(r.data, id)
+		for i := range r.meta.ItemLocation.Items {
+			if ent := &r.meta.ItemLocation.Items[i]; uint32(ent.ItemID) == id {
+				ent.ConstructionMethod = 1
+				ent.BaseOffset = 0
+				ent.ExtentCount = 1
+				ent.Extents = []bmff.OffsetLength{{Offset: uint64(len(idat.Data)), Length: uint64(len(data))}}
+			}
+		}
+		idat.Data = append(idat.Data, data...)
+	}
+	r.meta.ItemData = idat
+	r.meta.box.Children = append(r.meta.box.Children, idat)
+	return nil
+}
+
+func TestRewriteIdat(t *testing.T) {
+	f, err := os.Open("../testdata/camel.heic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	exif := append([]byte("MM\x00\x2a\x00\x00\x00\x08"), make([]byte, 6)...)
+	xmp := []byte(`<x:xmpmeta xmlns:x="adobe:ns:meta/"/>`)
+	src := rewritten(t, Open(f), SetEXIF(exif), SetXMP(xmp), toIdat)
+
+	idat := func(f *File) []byte {
+		t.Helper()
+		meta, err := f.getMeta()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if meta.ItemData == nil {
+			t.Fatal("no idat box")
+		}
+		return meta.ItemData.Data
+	}
+	// the EXIF item starts with the offset of the TIFF header
+	if got, want := idat(src), append(append([]byte("\x00\x00\x00\x00"), exif...), xmp...); !bytes.Equal(got, want) {
+		t.Fatalf("idat %q; want %q", got, want)
+	}
+
+	exif2 := append([]byte("II\x2a\x00\x08\x00\x00\x00"), make([]byte, 6)...)
+	for _, tt := range []struct {
+		name string
+		opt  RewriteOption
+		exif []byte
+	}{
+		{"RemoveEXIF", RemoveEXIF(), nil},
+		{"SetEXIF", SetEXIF(exif2), exif2},
+	} {
+		got := rewritten(t, src, tt.opt)
+		if data := idat(got); !bytes.Equal(data, xmp) {
+			t.Errorf("%s: idat %q; want only the XMP packet", tt.name, data)
+		}
+		if xmps := xmpItems(t, got); len(xmps) != 1 || !bytes.Equal(xmps[0], xmp) {
+			t.Errorf("%s: XMP items %q; want %q", tt.name, xmps, xmp)
+		}
+		data, err := got.EXIF()
+		if tt.exif == nil && !errors.Is(err, ErrNoEXIF) || tt.exif != nil && (err != nil || !bytes.Equal(data, tt.exif)) {
+			t.Errorf("%s: EXIF = %q, %v; want %q", tt.name, data, err, tt.exif)
+		}
+	}
+}
@@ -0,0 +1,386 @@
+package heif
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+
+	"github.com/jdeng/goheif/heif/bmff"
+)
+
+// Severity is the severity of a Finding.
+type Severity int
+
+const (
+	// SeverityInfo marks checks that could not be done.
+	SeverityInfo Severity = iota
+	// SeverityWarning marks files that readers may handle differently
+	// than intended, such as violations of MIAF rules.
+	SeverityWarning
+	// SeverityError marks violations of the HEIF rules.
+	SeverityError
+)
+
+func (s Severity) String() string {
+	switch s {
+	case SeverityInfo:
+		return "info"
+	case SeverityError:
+		return "error"
+	}
+	return "warning"
+}
+
+// A Finding is a violation of the HEIF or MIAF rules reported by
+// Validate, or a check it could not do.
+type Finding struct {
+	Severity Severity
+	Box      bmff.BoxType
+	Offset   int64  // of the box header, or -1 if unknown
+	ItemID   uint32 // 0 for findings not about an item
+	Text     string
+}
+
+func (f Finding) String() string {
+	s := fmt.Sprintf("%v: %q box", f.Severity, f.Box)
+	if f.Offset >= 0 {
+		s += fmt.Sprintf(" at offset %d", f.Offset)
+	}
+	if f.ItemID != 0 {
+		s += fmt.Sprintf(", item %d", f.ItemID)
+	}
+	return s + ": " + f.Text
+}
+
+// imageItemTypes are the item types of images, which need an ispe
+// property.
+var imageItemTypes = map[string]bool{
+	"hvc1": true,
+	"av01": true,
+	"jpeg": true,
+	"grid": true,
+	"iden": true,
+	"iovl": true,
+}
+
+// Validate checks the structure of a HEIF file against the rules of
+// HEIF and MIAF: the brands, the items, their locations, properties and
+// references, and the grid images. It does not decode the images.
+//
+// The extents of items are checked against the size of the file only if
+// ra has a Size method, like *bytes.Reader and *io.SectionReader, or is
+// an *os.File. Otherwise an info finding says they were not checked.
+//
+// Files that cannot be parsed are reported as a Finding, like the other
+// violations; the error is for failures to read ra and the limits of
+// the options.
+func Validate(ra io.ReaderAt, opts ...Option) ([]Finding, error) {
+	v := &validator{f: Open(ra, opts...), infos: map[uint32]*bmff.ItemInfoEntry{}}
+	meta, err := v.f.getMeta()
+	var be *bmff.BoxError
+	switch {
+	case errors.Is(err, ErrCorrupt) || errors.Is(err, ErrUnsupported) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF):
+		f := Finding{Severity: SeverityError, Offset: -1, Text: err.Error()}
+		if errors.As(err, &be) {
+			f.Box, f.Offset, f.Text = be.Type, be.Offset, be.Err.Error()
+		}
+		return []Finding{f}, nil
+	case err != nil:
+		return nil, err
+	}
+	v.meta = meta
+
+	v.checkBrands()
+	v.checkItems()
+	v.checkLocations()
+	v.checkProperties()
+	v.checkReferences()
+	if err := v.checkGrids(); err != nil {
+		return v.findings, err
+	}
+	return v.findings, nil
+}
+
+type validator struct {
+	f        *File
+	meta     *BoxMeta
+	infos    map[uint32]*bmff.ItemInfoEntry
+	ids      []uint32 // of infos, in file order
+	findings []Finding
+}
+
+// report adds a finding about the box b, which may be nil, and the item
+// of the given ID, or 0.
+func (v *validator) report(sev Severity, b bmff.Box, id uint32, format string, args ...any) {
+	f := Finding{Severity: sev, Offset: -1, ItemID: id, Text: fmt.Sprintf(format, args...)}
+	if b != nil {
+		f.Box = b.Type()
+		if ob, ok := b.(bmff.OffsetBox); ok {
+			f.Offset = ob.Offset()
+		}
+	}
+	v.findings = append(v.findings, f)
+}
+
+func (v *validator) checkBrands() {
+	ftyp := v.meta.FileType
+	brands := append([]string{ftyp.MajorBrand}, ftyp.Compatible...)
+	if !slices.Contains(brands, "mif1") && !slices.Contains(brands, "msf1") {
+		v.report(SeverityError, ftyp, 0, "neither mif1 nor msf1 brand")
+	}
+	if !slices.Contains(brands, "miaf") {
+		v.report(SeverityWarning, ftyp, 0, "no miaf brand")
+	}
+	switch hdlr := v.meta.Handler; {
+	case hdlr == nil:
+		v.report(SeverityError, v.meta.box, 0, "no hdlr box")
+	case hdlr.HandlerType != "pict":
+		v.report(SeverityError, hdlr, 0, "handler type %q; want \"pict\"", hdlr.HandlerType)
+	}
+}
+
+func (v *validator) checkItems() {
+	iinf := v.meta.ItemInfo
+	if iinf == nil {
+		v.report(SeverityError, v.meta.box, 0, "no iinf box")
+		return
+	}
+	for _, ife := range iinf.ItemInfos {
+		id := uint32(ife.ItemID)
+		if _, dup := v.infos[id]; dup {
+			v.report(SeverityError, ife, id, "duplicate item ID")
+			continue
+		}
+		v.infos[id] = ife
+		v.ids = append(v.ids, id)
+	}
+
+	pitm := v.meta.PrimaryItem
+	if pitm == nil {
+		v.report(SeverityError, v.meta.box, 0, "no pitm box")
+		return
+	}
+	switch ife := v.infos[uint32(pitm.ItemID)]; {
+	case ife == nil:
+		v.report(SeverityError, pitm, uint32(pitm.ItemID), "primary item does not exist")
+	case !imageItemTypes[ife.ItemType]:
+		v.report(SeverityError, pitm, uint32(pitm.ItemID), "primary item of type %q is not an image", ife.ItemType)
+	case ife.Flags&1 != 0:
+		v.report(SeverityError, pitm, uint32(pitm.ItemID), "primary item is hidden")
+	}
+}
+
+// fileSize returns the size of the file, or -1 if it is unknown.
+func (v *validator) fileSize() int64 {
+	switch ra := v.f.ra.(type) {
+	case interface{ Size() int64 }:
+		return ra.Size()
+	case *os.File:
+		if fi, err := ra.Stat(); err == nil {
+			return fi.Size()
+		}
+	}
+	return -1
+}
+
+func (v *validator) checkLocations() {
+	iloc := v.meta.ItemLocation
+	if iloc == nil {
+		if len(v.infos) > 0 {
+			v.report(SeverityError, v.meta.box, 0, "no iloc box")
+		}
+		return
+	}
+	size := v.fileSize()
+	unchecked := false
+	seen := map[uint32]bool{}
+	for _, ent := range iloc.Items {
+		id := uint32(ent.ItemID)
+		if seen[id] {
+			v.report(SeverityError, iloc, id, "duplicate location")
+		}
+		seen[id] = true
+		if v.infos[id] == nil {
+			v.report(SeverityError, iloc, id, "location of an item that does not exist")
+		}
+		if ent.DataReferenceIndex != 0 {
+			continue // in another file
+		}
+
+		var limit uint64
+		var where string
+		switch ent.ConstructionMethod {
+		case 0:
+			if size < 0 {
+				unchecked = true
+				continue
+			}
+			limit, where = uint64(size), "file"
+		case 1:
+			if v.meta.ItemData == nil {
+				v.report(SeverityError, iloc, id, "data in idat, but no idat box")
+				continue
+			}
+			limit, where = uint64(len(v.meta.ItemData.Data)), "idat box"
+		default:
+			continue
+		}
+		for _, ext := range ent.Extents {
+			start := ent.BaseOffset + ext.Offset
+			end := start + ext.Length
+			if start < ent.BaseOffset || end < start || end > limit || ext.Length == 0 && start > limit {
+				v.report(SeverityError, iloc, id, "extent of %d bytes at %d outside of the %s of %d bytes", ext.Length, start, where, limit)
+			}
+		}
+	}
+	for _, id := range v.ids {
+		if !seen[id] {
+			v.report(SeverityWarning, iloc, id, "item without location")
+		}
+	}
+	if unchecked {
+		v.report(SeverityInfo, iloc, 0, "extents in the file not checked, its size is unknown")
+	}
+}
+
+func (v *validator) checkProperties() {
+	iprp := v.meta.Properties
+	if iprp == nil {
+		v.report(SeverityError, v.meta.box, 0, "no iprp box")
+		return
+	}
+	props := iprp.PropertyContainer.Properties
+	assoc := map[uint32][]string{} // property types by item
+	for _, ipma := range iprp.Associations {
+		for _, ent := range ipma.Entries {
+			if v.infos[ent.ItemID] == nil {
+				v.report(SeverityError, ipma, ent.ItemID, "properties of an item that does not exist")
+			}
+			if _, dup := assoc[ent.ItemID]; dup {
+				v.report(SeverityError, ipma, ent.ItemID, "item with more than one entry")
+			}
+			types := []string{}
+			for _, p := range ent.Associations {
+				if p.Index == 0 {
+					continue
+				}
+				if int(p.Index) > len(props) {
+					v.report(SeverityError, ipma, ent.ItemID, "property index %d of %d properties", p.Index, len(props))
+					continue
+				}
+				typ := props[p.Index-1].Type().String()
+				if essentialProperties[typ] && !p.Essential {
+					v.report(SeverityError, ipma, ent.ItemID, "%s property not marked essential", typ)
+				}
+				types = append(types, typ)
+			}
+			assoc[ent.ItemID] = append(assoc[ent.ItemID], types...)
+		}
+	}
+
+	for _, id := range v.ids {
+		ife := v.infos[id]
+		if !imageItemTypes[ife.ItemType] {
+			continue
+		}
+		types := assoc[id]
+		if !slices.Contains(types, "ispe") {
+			v.report(SeverityError, ife, id, "%s image without ispe property", ife.ItemType)
+		}
+		if ife.ItemType == "hvc1" && !slices.Contains(types, "hvcC") {
+			v.report(SeverityError, ife, id, "hvc1 image without hvcC property")
+		}
+	}
+}
+
+func (v *validator) checkReferences() {
+	iref := v.meta.ItemReference
+	if iref == nil {
+		return
+	}
+	var types []string                         // in file order
+	graphs := map[string]map[uint32][]uint32{} // of each reference type
+	for _, ref := range iref.ItemRefs {
+		typ := ref.Type().String()
+		if v.infos[ref.FromItemID] == nil {
+			v.report(SeverityError, ref, ref.FromItemID, "%s reference from an item that does not exist", typ)
+		}
+		for _, to := range ref.ToItemIDs {
+			if v.infos[to] == nil {
+				v.report(SeverityError, ref, ref.FromItemID, "%s reference to item %d, which does not exist", typ, to)
+			}
+		}
+		if graphs[typ] == nil {
+			graphs[typ] = map[uint32][]uint32{}
+			types = append(types, typ)
+		}
+		graphs[typ][ref.FromItemID] = append(graphs[typ][ref.FromItemID], ref.ToItemIDs...)
+	}
+
+	for _, typ := range types {
+		graph := graphs[typ]
+		// depth-first, with the items on the path in progress
+		const inProgress, done = 1, 2
+		state := map[uint32]int{}
+		var visit func(id uint32) bool
+		visit = func(id uint32) bool {
+			switch state[id] {
+			case inProgress:
+				return true
+			case done:
+				return false
+			}
+			state[id] = inProgress
+			for _, to := range graph[id] {
+				if visit(to) {
+					return true
+				}
+			}
+			state[id] = done
+			return false
+		}
+		for _, ref := range iref.ItemRefs {
+			if ref.Type().String() == typ && state[ref.FromItemID] == 0 && visit(ref.FromItemID) {
+				v.report(SeverityError, ref, ref.FromItemID, "cycle of %s references", typ)
+				break
+			}
+		}
+	}
+}
+
+func (v *validator) checkGrids() error {
+	for _, id := range v.ids {
+		ife := v.infos[id]
+		if ife.ItemType != "grid" {
+			continue
+		}
+		it, err := v.f.ItemByID(id)
+		if err != nil {
+			return err
+		}
+		data, err := v.f.GetItemData(it)
+		if errors.Is(err, ErrCorrupt) || errors.Is(err, ErrUnsupported) {
+			v.report(SeverityError, ife, id, "grid data: %v", errors.Unwrap(err))
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		g, err := parseImageGrid(data)
+		if err != nil {
+			v.report(SeverityError, ife, id, "%v", err)
+			continue
+		}
+		dimg := it.Reference("dimg")
+		if dimg == nil {
+			v.report(SeverityError, ife, id, "grid without dimg reference")
+			continue
+		}
+		if n := len(dimg.ToItemIDs); n != g.rows*g.columns {
+			v.report(SeverityError, dimg, id, "%d tiles for a grid of %dx%d tiles", n, g.columns, g.rows)
+		}
+	}
+	return nil
+}
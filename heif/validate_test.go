@@ -0,0 +1,108 @@
+package heif
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/jdeng/goheif/heif/bmff"
+)
+
+func TestValidate(t *testing.T) {
+	f, err := os.Open("../testdata/camel.heic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	findings, err := Validate(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range findings {
+		if f.Severity == SeverityError {
+			t.Errorf("camel.heic: %v", f)
+		}
+	}
+	src := Open(f)
+	primary, err := src.PrimaryItem()
+	if err != nil {
+		t.Fatal(err)
+	}
+	img := testImage(t, src, primary)
+
+	// a grid of 2 tiles, items 1 and 2, broken in every way
+	w := NewWriter()
+	gridID, err := w.AddGrid(&Grid{Rows: 1, Columns: 2, Width: 2 * img.Width, Height: img.Height, Tiles: []*Image{img, img}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, chunks, err := w.meta()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range meta.Children {
+		switch b := b.(type) {
+		case *bmff.ItemInfoBox:
+			dup := *b.ItemInfos[1]
+			b.ItemInfos = append(b.ItemInfos, &dup)
+		case *bmff.ItemReferenceBox:
+			b.ItemRefs[0].ToItemIDs = []uint32{1, 2, 99}
+			b.ItemRefs = append(b.ItemRefs, bmff.NewItemReferenceEntry(bmff.BoxType{'d', 'i', 'm', 'g'}, 1, gridID))
+		case *bmff.ItemPropertiesBox:
+			ent := &b.Associations[0].Entries[0]
+			ent.Associations[0].Essential = false // hvcC
+			ent.Associations = ent.Associations[:1]
+		}
+	}
+	var buf bytes.Buffer
+	if _, err := writeFile(&buf, bmff.NewFileTypeBox("heic", "\x00\x00\x00\x00", "heic"), meta, chunks); err != nil {
+		t.Fatal(err)
+	}
+	// the data of the last tile, at the end of the file
+	findings, err = Validate(bytes.NewReader(buf.Bytes()[:buf.Len()-1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, f := range findings {
+		got = append(got, f.String())
+	}
+	for _, want := range []string{
+		`error: "ftyp" box at offset 0: neither mif1 nor msf1 brand`,
+		`warning: "ftyp" box at offset 0: no miaf brand`,
+		`"infe" box at offset `, `, item 2: duplicate item ID`,
+		`"iloc" box at offset `, `, item 2: extent of `,
+		`"ipma" box at offset `, `, item 1: hvcC property not marked essential`,
+		`"infe" box at offset `, `, item 1: hvc1 image without ispe property`,
+		`"dimg" box at offset `, `, item 3: dimg reference to item 99, which does not exist`,
+		`, item 3: cycle of dimg references`,
+		`, item 3: 3 tiles for a grid of 2x1 tiles`,
+	} {
+		if !slices.ContainsFunc(got, func(s string) bool { return strings.Contains(s, want) }) {
+			t.Errorf("no finding with %q in:\n%s", want, strings.Join(got, "\n"))
+		}
+	}
+
+	// a reader without a size
+	findings, err = Validate(struct{ io.ReaderAt }{bytes.NewReader(buf.Bytes()[:buf.Len()-1])})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.ContainsFunc(findings, func(f Finding) bool {
+		return f.Severity == SeverityInfo && strings.Contains(f.Text, "not checked")
+	}) {
+		t.Errorf("Validate of a reader without a size: no info finding in %v", findings)
+	}
+	if slices.ContainsFunc(findings, func(f Finding) bool { return strings.Contains(f.Text, "extent of ") }) {
+		t.Errorf("Validate of a reader without a size checked the extents: %v", findings)
+	}
+
+	findings, err = Validate(strings.NewReader("not a HEIF file"))
+	if err != nil || len(findings) != 1 || findings[0].Severity != SeverityError {
+		t.Errorf("Validate of a text file = %v, %v; want one error", findings, err)
+	}
+}
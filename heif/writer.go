@@ -0,0 +1,535 @@
+package heif
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/jdeng/goheif/heif/bmff"
+	"github.com/jdeng/goheif/hevc"
+)
+
+// Image is a coded HEVC image to add to a Writer.
+type Image struct {
+	Width, Height int
+
+	// Config is the decoder configuration, with the parameter sets.
+	Config *bmff.ItemHevcConfigBox
+
+	// Data holds the NAL units of the coded picture, each preceded by
+	// its length in Config.LengthSize() bytes, as in the item data of a
+	// file.
+	Data []byte
+
+	// Properties are further properties of the image, such as
+	// bmff.NewImageRotation(1).
+	Properties []bmff.Box
+}
+
+// ImageFromAnnexB returns the Image of a picture coded as a byte stream
+// in the format of Annex B of the HEVC standard, as written by most
+// encoders. The parameter sets of the stream go into the Config and the
+// size is taken from the SPS.
+func ImageFromAnnexB(stream []byte) (*Image, error) {
+	units, err := hevc.SplitAnnexB(stream)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		arrays   []*bmff.HevcNalArray
+		sps      *hevc.SPS
+		data     []byte
+		pictures int
+	)
+	for _, unit := range units {
+		switch typ := hevc.NALUnitType(unit); typ {
+		case hevc.NALUnitVPS, hevc.NALUnitSPS, hevc.NALUnitPPS:
+			if typ == hevc.NALUnitSPS && sps == nil {
+				if sps, err = hevc.ParseSPS(unit); err != nil {
+					return nil, err
+				}
+			}
+			arrays = appendNalUnit(arrays, uint8(typ), unit)
+		case 35: // access unit delimiter
+		default:
+			// first_slice_segment_in_pic_flag starts every picture
+			if typ < 32 && len(unit) > 2 && unit[2]&0x80 != 0 {
+				if pictures++; pictures > 1 {
+					return nil, fmt.Errorf("heif: HEVC stream of more than one picture: %w", hevc.ErrInvalid)
+				}
+			}
+			data = binary.BigEndian.AppendUint32(data, uint32(len(unit)))
+			data = append(data, unit...)
+		}
+	}
+	if sps == nil || pictures == 0 {
+		return nil, fmt.Errorf("heif: HEVC stream without SPS or picture: %w", hevc.ErrInvalid)
+	}
+
+	var tierFlag, temporalIDNested uint8
+	if sps.TierFlag {
+		tierFlag = 1
+	}
+	if sps.TemporalIDNesting {
+		temporalIDNested = 1
+	}
+	config := bmff.HevcConfig{
+		Version:                          1,
+		GeneralProfileSpace:              sps.ProfileSpace,
+		GeneralTierFlag:                  tierFlag,
+		GeneralProfileIdc:                sps.ProfileIdc,
+		GeneralProfileCompatibilityFlags: sps.ProfileCompatibilityFlags,
+		GeneralConstraintIndicatorFlags:  sps.ConstraintIndicatorFlags,
+		GeneralLevelIdc:                  sps.LevelIdc,
+		ChromaFormat:                     uint8(sps.ChromaFormatIdc),
+		BitDepthLuma:                     uint8(sps.BitDepthLuma),
+		BitDepthChroma:                   uint8(sps.BitDepthChroma),
+		NumTemporalLayers:                uint8(sps.MaxSubLayers),
+		TemporalIdNested:                 temporalIDNested,
+		LengthSizeMinusOne:               3,
+	}
+	w, h := sps.DisplaySize()
+	return &Image{
+		Width:  w,
+		Height: h,
+		Config: bmff.NewItemHevcConfigBox(config, arrays),
+		Data:   data,
+	}, nil
+}
+
+// appendNalUnit adds a parameter set to the array of its type, unless it
+// is a repetition.
+func appendNalUnit(arrays []*bmff.HevcNalArray, typ uint8, unit []byte) []*bmff.HevcNalArray {
+	for _, na := range arrays {
+		if na.UnitType != typ {
+			continue
+		}
+		for _, u := range na.Units {
+			if bytes.Equal(u, unit) {
+				return arrays
+			}
+		}
+		na.Units = append(na.Units, unit)
+		return arrays
+	}
+	return append(arrays, &bmff.HevcNalArray{Completeness: 1, UnitType: typ, Units: [][]byte{unit}})
+}
+
+// Grid is an image made of tiles of the same size, as written by cameras
+// for large images.
+type Grid struct {
+	Rows, Columns int
+
+	// Width and Height are the size of the image. The tiles on the right
+	// and bottom edges are cropped to it.
+	Width, Height int
+
+	// Tiles are the images of the grid, row by row.
+	Tiles []*Image
+
+	// Properties are further properties of the grid image, such as
+	// bmff.NewImageRotation(1).
+	Properties []bmff.Box
+}
+
+// Writer assembles a HEIF file from coded images and metadata. Items are
+// numbered from 1 in the order they are added; the first image or grid
+// added is the primary item unless SetPrimary is called.
+type Writer struct {
+	items   []*writerItem
+	refs    []*bmff.ItemReferenceEntry
+	primary uint32
+}
+
+type writerItem struct {
+	id          uint32
+	typ         string
+	contentType string // of "mime" items
+	hidden      bool
+	data        []byte
+	inIdat      bool
+	props       []bmff.Box
+}
+
+// NewWriter returns a Writer without items.
+func NewWriter() *Writer {
+	return &Writer{}
+}
+
+// essentialProperties lists the properties that readers must not ignore,
+// as they change the image.
+var essentialProperties = map[string]bool{
+	"hvcC": true,
+	"irot": true,
+	"imir": true,
+	"clap": true,
+}
+
+func (w *Writer) add(it *writerItem) (uint32, error) {
+	if len(w.items) >= math.MaxUint16 {
+		return 0, fmt.Errorf("heif: more than %d items", math.MaxUint16)
+	}
+	it.id = uint32(len(w.items) + 1)
+	w.items = append(w.items, it)
+	return it.id, nil
+}
+
+func (w *Writer) item(id uint32) (*writerItem, error) {
+	if id == 0 || id > uint32(len(w.items)) {
+		return nil, &ItemError{ItemID: id, Err: ErrUnknownItem}
+	}
+	return w.items[id-1], nil
+}
+
+// imageItem returns the item of a coded image.
+func imageItem(img *Image, hidden bool) (*writerItem, error) {
+	switch {
+	case img.Config == nil:
+		return nil, errors.New("heif: image without hvcC")
+	case img.Width <= 0 || img.Height <= 0 || img.Width > math.MaxUint32 || img.Height > math.MaxUint32:
+		return nil, fmt.Errorf("heif: image size %dx%d", img.Width, img.Height)
+	case len(img.Data) == 0:
+		return nil, errors.New("heif: image without data")
+	}
+	props := []bmff.Box{img.Config, spatialExtents(img.Width, img.Height), pixiProperty(img.Config.Config())}
+	return &writerItem{
+		typ:    "hvc1",
+		hidden: hidden,
+		data:   img.Data,
+		props:  append(props, img.Properties...),
+	}, nil
+}
+
+func spatialExtents(width, height int) bmff.Box {
+	return &bmff.ImageSpatialExtentsProperty{
+		FullBox:     bmff.NewFullBox(bmff.TypeIspe, 0, 0),
+		ImageWidth:  uint32(width),
+		ImageHeight: uint32(height),
+	}
+}
+
+// pixiProperty returns the "pixi" property with the bit depths of
+// the channels.
+func pixiProperty(c bmff.HevcConfig) bmff.Box {
+	body := []byte{0, 0, 0, 0, 3, c.BitDepthLuma, c.BitDepthChroma, c.BitDepthChroma}
+	if c.ChromaFormat == 0 {
+		body = []byte{0, 0, 0, 0, 1, c.BitDepthLuma}
+	}
+	return bmff.NewBox(bmff.BoxType{'p', 'i', 'x', 'i'}, body)
+}
+
+// AddImage adds a coded image and returns its item ID.
+func (w *Writer) AddImage(img *Image) (uint32, error) {
+	it, err := imageItem(img, false)
+	if err != nil {
+		return 0, err
+	}
+	id, err := w.add(it)
+	if err == nil && w.primary == 0 {
+		w.primary = id
+	}
+	return id, err
+}
+
+// AddGrid adds a grid image and its tiles, as hidden items, and returns
+// the item ID of the grid.
+func (w *Writer) AddGrid(g *Grid) (uint32, error) {
+	if g.Rows < 1 || g.Rows > 256 || g.Columns < 1 || g.Columns > 256 {
+		return 0, fmt.Errorf("heif: grid of %dx%d tiles", g.Columns, g.Rows)
+	}
+	if len(g.Tiles) != g.Rows*g.Columns {
+		return 0, fmt.Errorf("heif: %d tiles for a grid of %dx%d tiles", len(g.Tiles), g.Columns, g.Rows)
+	}
+	tw, th := g.Tiles[0].Width, g.Tiles[0].Height
+	for _, tile := range g.Tiles {
+		if tile.Width != tw || tile.Height != th {
+			return 0, fmt.Errorf("heif: grid tiles of sizes %dx%d and %dx%d", tw, th, tile.Width, tile.Height)
+		}
+	}
+	// every tile must show part of the image
+	if g.Width <= (g.Columns-1)*tw || g.Width > g.Columns*tw || g.Height <= (g.Rows-1)*th || g.Height > g.Rows*th {
+		return 0, fmt.Errorf("heif: grid size %dx%d for %dx%d tiles of %dx%d", g.Width, g.Height, g.Columns, g.Rows, tw, th)
+	}
+
+	var tiles []*writerItem
+	for _, tile := range g.Tiles {
+		it, err := imageItem(tile, true)
+		if err != nil {
+			return 0, err
+		}
+		tiles = append(tiles, it)
+	}
+	if len(w.items)+len(tiles)+1 > math.MaxUint16 {
+		return 0, fmt.Errorf("heif: more than %d items", math.MaxUint16)
+	}
+	var ids []uint32
+	for _, it := range tiles {
+		id, _ := w.add(it)
+		ids = append(ids, id)
+	}
+
+	data := gridData(g.Rows, g.Columns, g.Width, g.Height)
+	props := []bmff.Box{spatialExtents(g.Width, g.Height), pixiProperty(g.Tiles[0].Config.Config())}
+	id, _ := w.add(&writerItem{
+		typ:    "grid",
+		data:   data,
+		inIdat: true,
+		props:  append(props, g.Properties...),
+	})
+	w.refs = append(w.refs, bmff.NewItemReferenceEntry(bmff.BoxType{'d', 'i', 'm', 'g'}, id, ids...))
+	if w.primary == 0 {
+		w.primary = id
+	}
+	return id, nil
+}
+
+// gridData returns the ImageGrid data of a grid item, with 32-bit sizes
+// if needed.
+func gridData(rows, columns, width, height int) []byte {
+	data := []byte{0, 0, uint8(rows - 1), uint8(columns - 1)}
+	if width > math.MaxUint16 || height > math.MaxUint16 {
+		data[1] = 1
+		data = binary.BigEndian.AppendUint32(data, uint32(width))
+		data = binary.BigEndian.AppendUint32(data, uint32(height))
+	} else {
+		data = binary.BigEndian.AppendUint16(data, uint16(width))
+		data = binary.BigEndian.AppendUint16(data, uint16(height))
+	}
+	return data
+}
+
+// AddThumbnail adds a coded image as the thumbnail of the image with the
+// given item ID, and returns the ID of the thumbnail.
+func (w *Writer) AddThumbnail(of uint32, img *Image) (uint32, error) {
+	if _, err := w.item(of); err != nil {
+		return 0, err
+	}
+	it, err := imageItem(img, false)
+	if err != nil {
+		return 0, err
+	}
+	id, err := w.add(it)
+	if err != nil {
+		return 0, err
+	}
+	w.refs = append(w.refs, bmff.NewItemReferenceEntry(bmff.BoxType{'t', 'h', 'm', 'b'}, id, of))
+	return id, nil
+}
+
+// AddEXIF adds EXIF metadata describing the image with the given item
+// ID, and returns the ID of the metadata item. The data is as returned
+// by File.EXIF: a TIFF header, optionally preceded by "Exif\x00\x00".
+func (w *Writer) AddEXIF(of uint32, exif []byte) (uint32, error) {
+	return w.addMetadata(of, exifItem(exif))
+}
+
+// exifItem returns the item of EXIF data as returned by File.EXIF.
+func exifItem(exif []byte) *writerItem {
+	var offset uint32 // of the TIFF header
+	if bytes.HasPrefix(exif, []byte("Exif\x00\x00")) {
+		offset = 6
+	}
+	data := binary.BigEndian.AppendUint32(nil, offset)
+	return &writerItem{typ: "Exif", data: append(data, exif...)}
+}
+
+// AddXMP adds an XMP packet describing the image with the given item ID,
+// and returns the ID of the metadata item.
+func (w *Writer) AddXMP(of uint32, xmp []byte) (uint32, error) {
+	return w.addMetadata(of, xmpItem(xmp))
+}
+
+func xmpItem(xmp []byte) *writerItem {
+	return &writerItem{typ: "mime", contentType: xmpContentType, data: xmp}
+}
+
+func (w *Writer) addMetadata(of uint32, it *writerItem) (uint32, error) {
+	if _, err := w.item(of); err != nil {
+		return 0, err
+	}
+	id, err := w.add(it)
+	if err != nil {
+		return 0, err
+	}
+	w.refs = append(w.refs, bmff.NewItemReferenceEntry(bmff.BoxType{'c', 'd', 's', 'c'}, id, of))
+	return id, nil
+}
+
+// SetPrimary makes the image with the given item ID the primary item.
+func (w *Writer) SetPrimary(id uint32) error {
+	it, err := w.item(id)
+	if err != nil {
+		return err
+	}
+	if it.typ != "hvc1" && it.typ != "grid" {
+		return &ItemError{ItemID: id, Err: fmt.Errorf("%q item is not an image", it.typ)}
+	}
+	w.primary = id
+	return nil
+}
+
+// WriteTo writes the file to out: an "ftyp" box, the "meta" box and an
+// "mdat" box with the coded images and metadata items.
+func (w *Writer) WriteTo(out io.Writer) (int64, error) {
+	if w.primary == 0 {
+		return 0, errors.New("heif: no image to write")
+	}
+	meta, chunks, err := w.meta()
+	if err != nil {
+		return 0, err
+	}
+	ftyp := bmff.NewFileTypeBox("heic", "\x00\x00\x00\x00", "mif1", "miaf", "heic")
+	return writeFile(out, ftyp, meta, chunks)
+}
+
+// mdatChunk is item data to write in the mdat box, at the offset to set
+// in ext.
+type mdatChunk struct {
+	ext  *bmff.OffsetLength
+	data io.Reader
+	size int64
+}
+
+// writeFile writes the ftyp and meta boxes, then an mdat box with the
+// chunks. The offsets of the chunks are set in the meta box first.
+func writeFile(out io.Writer, ftyp *bmff.FileTypeBox, meta *bmff.MetaBox, chunks []mdatChunk) (int64, error) {
+	ftypData, err := bmff.Marshal(ftyp)
+	if err != nil {
+		return 0, err
+	}
+	var mdatSize int64
+	for _, c := range chunks {
+		mdatSize += c.size
+	}
+	mdatHeader := binary.BigEndian.AppendUint32(nil, uint32(8+mdatSize))
+	mdatHeader = append(mdatHeader, bmff.TypeMdat[:]...)
+	if 8+mdatSize > math.MaxUint32 {
+		mdatHeader = binary.BigEndian.AppendUint32(nil, 1)
+		mdatHeader = append(mdatHeader, bmff.TypeMdat[:]...)
+		mdatHeader = binary.BigEndian.AppendUint64(mdatHeader, uint64(16+mdatSize))
+	}
+
+	// The offsets of the chunks depend on the size of the meta box,
+	// which depends on the size of the offsets.
+	var metaData []byte
+	for size := 0; ; size = len(metaData) {
+		off := uint64(len(ftypData) + size + len(mdatHeader))
+		for _, c := range chunks {
+			c.ext.Offset = off
+			off += uint64(c.size)
+		}
+		if metaData, err = bmff.Marshal(meta); err != nil {
+			return 0, err
+		}
+		if len(metaData) == size {
+			break
+		}
+	}
+
+	var n int64
+	for _, b := range [][]byte{ftypData, metaData, mdatHeader} {
+		m, err := out.Write(b)
+		n += int64(m)
+		if err != nil {
+			return n, err
+		}
+	}
+	for _, c := range chunks {
+		m, err := io.CopyN(out, c.data, c.size)
+		n += m
+		if err == io.EOF {
+			err = fmt.Errorf("heif: item data of %d bytes; want %d: %w", m, c.size, ErrCorrupt)
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// meta returns the meta box of the file and the item data to write in
+// the mdat box.
+func (w *Writer) meta() (*bmff.MetaBox, []mdatChunk, error) {
+	iinf := &bmff.ItemInfoBox{FullBox: bmff.NewFullBox(bmff.TypeIinf, 0, 0)}
+	iloc := &bmff.ItemLocationBox{FullBox: bmff.NewFullBox(bmff.TypeIloc, 0, 0)}
+	ipma := &bmff.ItemPropertyAssociation{FullBox: bmff.NewFullBox(bmff.TypeIpma, 0, 0)}
+	var (
+		props   []bmff.Box
+		propIdx = map[string]uint16{} // by encoding, to share them
+		idat    []byte
+		chunks  []mdatChunk
+	)
+	for _, it := range w.items {
+		var flags uint32
+		if it.hidden {
+			flags = 1
+		}
+		iinf.ItemInfos = append(iinf.ItemInfos, &bmff.ItemInfoEntry{
+			FullBox:     bmff.NewFullBox(bmff.TypeInfe, 2, flags),
+			ItemID:      uint16(it.id),
+			ItemType:    it.typ,
+			ContentType: it.contentType,
+		})
+
+		ent := bmff.ItemLocationBoxEntry{ItemID: uint16(it.id), ExtentCount: 1}
+		if it.inIdat {
+			ent.ConstructionMethod = 1
+			ent.Extents = []bmff.OffsetLength{{Offset: uint64(len(idat)), Length: uint64(len(it.data))}}
+			idat = append(idat, it.data...)
+		} else {
+			ent.Extents = []bmff.OffsetLength{{Length: uint64(len(it.data))}}
+			chunks = append(chunks, mdatChunk{&ent.Extents[0], bytes.NewReader(it.data), int64(len(it.data))})
+		}
+		iloc.Items = append(iloc.Items, ent)
+
+		if len(it.props) == 0 {
+			continue
+		}
+		assoc := bmff.ItemPropertyAssociationItem{ItemID: it.id, AssociationsCount: len(it.props)}
+		for _, p := range it.props {
+			enc, err := bmff.Marshal(p)
+			if err != nil {
+				return nil, nil, &ItemError{ItemID: it.id, Err: err}
+			}
+			key := string(enc)
+			idx, ok := propIdx[key]
+			if !ok {
+				props = append(props, p)
+				idx = uint16(len(props))
+				propIdx[key] = idx
+			}
+			assoc.Associations = append(assoc.Associations, bmff.ItemProperty{
+				Essential: essentialProperties[p.Type().String()],
+				Index:     idx,
+			})
+		}
+		ipma.Entries = append(ipma.Entries, assoc)
+	}
+	iinf.Count = uint32(len(iinf.ItemInfos))
+	iloc.ItemCount = uint16(len(iloc.Items))
+	ipma.EntryCount = uint32(len(ipma.Entries))
+
+	children := []bmff.Box{
+		&bmff.HandlerBox{FullBox: bmff.NewFullBox(bmff.TypeHdlr, 0, 0), HandlerType: "pict"},
+		bmff.NewDataInformationBox(&bmff.DataReferenceBox{
+			FullBox:    bmff.NewFullBox(bmff.TypeDref, 0, 0),
+			EntryCount: 1,
+			// the data is in this file
+			Children: []bmff.Box{bmff.NewBox(bmff.BoxType{'u', 'r', 'l', ' '}, []byte{0, 0, 0, 1})},
+		}),
+		&bmff.PrimaryItemBox{FullBox: bmff.NewFullBox(bmff.TypePitm, 0, 0), ItemID: uint16(w.primary)},
+		iinf,
+	}
+	if len(w.refs) > 0 {
+		children = append(children, &bmff.ItemReferenceBox{FullBox: bmff.NewFullBox(bmff.TypeIref, 0, 0), ItemRefs: w.refs})
+	}
+	children = append(children, bmff.NewItemPropertiesBox(props, ipma))
+	if idat != nil {
+		children = append(children, &bmff.ItemDataBox{FullBox: bmff.NewFullBox(bmff.TypeIdat, 0, 0), Data: idat})
+	}
+	children = append(children, iloc)
+	return &bmff.MetaBox{FullBox: bmff.NewFullBox(bmff.TypeMeta, 0, 0), Children: children}, chunks, nil
+}
@@ -0,0 +1,203 @@
+package heif
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/jdeng/goheif/heif/bmff"
+)
+
+// testImage returns the Image of an hvc1 item.
+func testImage(t *testing.T, f *File, it *Item) *Image {
+	t.Helper()
+	hvcc, ok := it.HevcConfig()
+	if !ok {
+		t.Fatalf("item %d has no hvcC", it.ID)
+	}
+	w, h, ok := it.SpatialExtents()
+	if !ok {
+		t.Fatalf("item %d has no ispe", it.ID)
+	}
+	data, err := f.GetItemData(it)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Image{Width: w, Height: h, Config: hvcc, Data: data}
+}
+
+func TestWriter(t *testing.T) {
+	f, err := os.Open("../testdata/camel.heic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	src := Open(f)
+	primary, err := src.PrimaryItem()
+	if err != nil {
+		t.Fatal(err)
+	}
+	img := testImage(t, src, primary)
+	thumb, err := src.ItemByID(primary.ID + 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exif := append([]byte("Exif\x00\x00MM\x00\x2a\x00\x00\x00\x08"), make([]byte, 6)...)
+
+	w := NewWriter()
+	imgID, err := w.AddImage(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gridID, err := w.AddGrid(&Grid{
+		Rows: 1, Columns: 2,
+		Width: 2*img.Width - 10, Height: img.Height,
+		Tiles:      []*Image{img, img},
+		Properties: []bmff.Box{bmff.NewImageRotation(1)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	thumbID, err := w.AddThumbnail(gridID, testImage(t, src, thumb))
+	if err != nil {
+		t.Fatal(err)
+	}
+	exifID, err := w.AddEXIF(gridID, exif)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.SetPrimary(gridID); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.SetPrimary(exifID); err == nil {
+		t.Errorf("SetPrimary of an EXIF item succeeded")
+	}
+	var buf bytes.Buffer
+	n, err := w.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(buf.Len()) {
+		t.Errorf("WriteTo = %d; wrote %d bytes", n, buf.Len())
+	}
+	findings, err := Validate(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range findings {
+		t.Errorf("Validate: %v", f)
+	}
+
+	hf := Open(bytes.NewReader(buf.Bytes()))
+	grid, err := hf.PrimaryItem()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if grid.ID != gridID || grid.Info.ItemType != "grid" {
+		t.Fatalf("primary item %d of type %q; want grid %d", grid.ID, grid.Info.ItemType, gridID)
+	}
+	if w, h, _ := grid.SpatialExtents(); w != 2*img.Width-10 || h != img.Height {
+		t.Errorf("grid size %dx%d; want %dx%d", w, h, 2*img.Width-10, img.Height)
+	}
+	if grid.Rotations() != 1 {
+		t.Errorf("grid rotation %d; want 1", grid.Rotations())
+	}
+	data, err := hf.GetItemData(grid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := binary.BigEndian.AppendUint16([]byte{0, 0, 0, 1}, uint16(2*img.Width-10))
+	want = binary.BigEndian.AppendUint16(want, uint16(img.Height))
+	if !bytes.Equal(data, want) {
+		t.Errorf("grid data %x; want %x", data, want)
+	}
+
+	dimg := grid.Reference("dimg")
+	if dimg == nil || len(dimg.ToItemIDs) != 2 {
+		t.Fatalf("dimg reference %+v; want 2 tiles", dimg)
+	}
+	for _, id := range append(dimg.ToItemIDs, imgID) {
+		it, err := hf.ItemByID(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := testImage(t, hf, it)
+		if got.Width != img.Width || got.Height != img.Height || !bytes.Equal(got.Data, img.Data) {
+			t.Errorf("item %d: %dx%d image of %d bytes; want %dx%d of %d", id, got.Width, got.Height, len(got.Data), img.Width, img.Height, len(img.Data))
+		}
+		if !reflect.DeepEqual(got.Config.NalArrays(), img.Config.NalArrays()) || got.Config.Config() != img.Config.Config() {
+			t.Errorf("item %d: hvcC differs", id)
+		}
+		if hidden := it.Info.Flags&1 != 0; hidden != (id != imgID) {
+			t.Errorf("item %d hidden = %v", id, hidden)
+		}
+	}
+
+	it, err := hf.ItemByID(thumbID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if thmb := it.Reference("thmb"); thmb == nil || thmb.ToItemIDs[0] != gridID {
+		t.Errorf("thmb reference %+v; want one to %d", thmb, gridID)
+	}
+	if got, err := hf.EXIF(); err != nil || !bytes.Equal(got, exif) {
+		t.Errorf("EXIF = %q, %v; want %q", got, err, exif)
+	}
+}
+
+func TestImageFromAnnexB(t *testing.T) {
+	f, err := os.Open("../testdata/camel.heic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	src := Open(f)
+	primary, err := src.PrimaryItem()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := testImage(t, src, primary)
+	if want.Config.LengthSize() != 4 {
+		t.Fatalf("test file has NAL unit lengths of %d bytes", want.Config.LengthSize())
+	}
+
+	var stream []byte
+	for _, na := range want.Config.NalArrays() {
+		for _, unit := range na.Units {
+			stream = append(append(stream, 0, 0, 0, 1), unit...)
+		}
+	}
+	for data := want.Data; len(data) > 4; {
+		n := binary.BigEndian.Uint32(data)
+		stream = append(append(stream, 0, 0, 1), data[4:4+n]...)
+		data = data[4+n:]
+	}
+
+	got, err := ImageFromAnnexB(stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Width != want.Width || got.Height != want.Height {
+		t.Errorf("size %dx%d; want %dx%d", got.Width, got.Height, want.Width, want.Height)
+	}
+	if !bytes.Equal(got.Data, want.Data) {
+		t.Errorf("data differs")
+	}
+	for _, typ := range []uint8{32, 33, 34} {
+		if !reflect.DeepEqual(got.Config.NalUnits(typ), want.Config.NalUnits(typ)) {
+			t.Errorf("NAL units of type %d differ", typ)
+		}
+	}
+	gc, wc := got.Config.Config(), want.Config.Config()
+	if gc.GeneralProfileIdc != wc.GeneralProfileIdc || gc.GeneralLevelIdc != wc.GeneralLevelIdc ||
+		gc.GeneralProfileCompatibilityFlags != wc.GeneralProfileCompatibilityFlags ||
+		gc.ChromaFormat != wc.ChromaFormat || gc.BitDepthLuma != wc.BitDepthLuma {
+		t.Errorf("hvcC configuration %+v; want %+v", gc, wc)
+	}
+
+	if _, err := ImageFromAnnexB(append(stream, stream...)); err == nil {
+		t.Errorf("ImageFromAnnexB of two pictures succeeded")
+	}
+}
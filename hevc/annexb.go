@@ -0,0 +1,44 @@
+package hevc
+
+import (
+	"bytes"
+	"fmt"
+)
+
+var startCode = []byte{0, 0, 1}
+
+// SplitAnnexB splits a byte stream in the format of Annex B of the
+// standard, as written by most encoders, into its NAL units. The units
+// exclude the start codes and the zero bytes that may follow them.
+func SplitAnnexB(stream []byte) ([][]byte, error) {
+	i := bytes.Index(stream, startCode)
+	if i < 0 || len(bytes.Trim(stream[:i], "\x00")) > 0 {
+		return nil, fmt.Errorf("%w: no start code at the beginning of the stream", ErrInvalid)
+	}
+	var units [][]byte
+	for rest := stream[i+len(startCode):]; len(rest) > 0; {
+		unit := rest
+		rest = nil
+		if j := bytes.Index(unit, startCode); j >= 0 {
+			unit, rest = unit[:j], unit[j+len(startCode):]
+		}
+		// a unit cannot end with a zero byte, which belongs to
+		// trailing_zero_8bits or a four byte start code
+		unit = bytes.TrimRight(unit, "\x00")
+		if len(unit) > 0 {
+			units = append(units, unit)
+		}
+	}
+	return units, nil
+}
+
+// AppendAnnexB appends the NAL units to dst in the format of Annex B,
+// each preceded by a four byte start code.
+func AppendAnnexB(dst []byte, units ...[]byte) []byte {
+	for _, unit := range units {
+		dst = append(dst, 0)
+		dst = append(dst, startCode...)
+		dst = append(dst, unit...)
+	}
+	return dst
+}
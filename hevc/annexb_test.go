@@ -0,0 +1,37 @@
+package hevc_test
+
+import (
+	"reflect"
+	"testing"
+
+	. "github.com/jdeng/goheif/hevc"
+)
+
+func TestSplitAnnexB(t *testing.T) {
+	stream := []byte{
+		0, 0, 0, 1, 0x40, 0x01, 0x0c, // VPS after a four byte start code
+		0, 0, 1, 0x42, 0x01, 0x00, 0x00, 0x03, 0x01, // SPS with an emulation prevention byte
+		0, 0, 1, 0x26, 0x01, 0xaf, 0, 0, // slice with trailing zeros
+	}
+	units, err := SplitAnnexB(stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]byte{
+		{0x40, 0x01, 0x0c},
+		{0x42, 0x01, 0x00, 0x00, 0x03, 0x01},
+		{0x26, 0x01, 0xaf},
+	}
+	if !reflect.DeepEqual(units, want) {
+		t.Errorf("SplitAnnexB = %x; want %x", units, want)
+	}
+
+	again, err := SplitAnnexB(AppendAnnexB(nil, units...))
+	if err != nil || !reflect.DeepEqual(again, want) {
+		t.Errorf("SplitAnnexB(AppendAnnexB(units)) = %x, %v; want %x", again, err, want)
+	}
+
+	if _, err := SplitAnnexB([]byte{0x40, 0x01, 0, 0, 1, 0x42}); err == nil {
+		t.Errorf("SplitAnnexB of a stream not starting with a start code succeeded")
+	}
+}
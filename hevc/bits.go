@@ -0,0 +1,83 @@
+package hevc
+
+import "fmt"
+
+// unescape removes the emulation prevention bytes from the payload of a
+// NAL unit, turning every 0x000003 into 0x0000.
+func unescape(b []byte) []byte {
+	out := make([]byte, 0, len(b))
+	zeros := 0
+	for _, c := range b {
+		if zeros >= 2 && c == 3 {
+			zeros = 0
+			continue
+		}
+		out = append(out, c)
+		if c == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	return out
+}
+
+// bitReader reads the fields of an RBSP. Reading past the end sets err
+// and returns zeros, so a parser can check for errors once at the end.
+type bitReader struct {
+	buf []byte
+	pos int // in bits
+	err error
+}
+
+func (br *bitReader) u(n int) uint32 {
+	var v uint32
+	for i := 0; i < n; i++ {
+		if br.pos >= len(br.buf)*8 {
+			if br.err == nil {
+				br.err = fmt.Errorf("%w: truncated", ErrInvalid)
+			}
+			return 0
+		}
+		bit := br.buf[br.pos/8] >> (7 - uint(br.pos%8)) & 1
+		v = v<<1 | uint32(bit)
+		br.pos++
+	}
+	return v
+}
+
+func (br *bitReader) flag() bool {
+	return br.u(1) == 1
+}
+
+func (br *bitReader) skip(n int) {
+	for ; n > 32; n -= 32 {
+		br.u(32)
+	}
+	br.u(n)
+}
+
+// ue reads an unsigned Exp-Golomb code.
+func (br *bitReader) ue() uint32 {
+	zeros := 0
+	for br.u(1) == 0 {
+		if br.err != nil {
+			return 0
+		}
+		zeros++
+		if zeros > 31 {
+			br.err = fmt.Errorf("%w: Exp-Golomb code too long", ErrInvalid)
+			return 0
+		}
+	}
+	return 1<<uint(zeros) - 1 + br.u(zeros)
+}
+
+// se reads a signed Exp-Golomb code.
+func (br *bitReader) se() int32 {
+	v := br.ue()
+	if v&1 == 1 {
+		return int32(v/2 + 1)
+	}
+	return -int32(v / 2)
+}
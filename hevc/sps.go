@@ -0,0 +1,303 @@
+// Package hevc parses the HEVC (H.265) parameter sets found in hvcC
+// boxes, enough to tell the size and format of a picture without
+// decoding it.
+package hevc
+
+import (
+	"errors"
+	"fmt"
+)
+
+// NAL unit types of the parameter sets.
+const (
+	NALUnitVPS = 32
+	NALUnitSPS = 33
+	NALUnitPPS = 34
+)
+
+// ErrInvalid is wrapped by the errors for malformed parameter sets.
+var ErrInvalid = errors.New("hevc: invalid parameter set")
+
+// NALUnitType returns the type of a NAL unit from its header.
+func NALUnitType(nal []byte) int {
+	if len(nal) == 0 {
+		return -1
+	}
+	return int(nal[0]>>1) & 0x3F
+}
+
+// Window is a conformance window, in luma samples.
+type Window struct {
+	Left, Right, Top, Bottom int
+}
+
+// VUI holds the colour description of the video usability information.
+type VUI struct {
+	AspectRatioIdc uint8
+	SarWidth       uint16 // with AspectRatioIdc 255
+	SarHeight      uint16
+
+	VideoSignalTypePresent  bool
+	VideoFormat             uint8
+	VideoFullRange          bool
+	ColourDescription       bool
+	ColourPrimaries         uint8
+	TransferCharacteristics uint8
+	MatrixCoefficients      uint8
+}
+
+// SPS is a sequence parameter set.
+type SPS struct {
+	VPSID             uint8
+	MaxSubLayers      int
+	TemporalIDNesting bool
+	ID                uint32
+
+	ProfileSpace              uint8
+	TierFlag                  bool
+	ProfileIdc                uint8 // 1 Main, 2 Main 10, 3 Main Still Picture, 4 range extensions
+	ProfileCompatibilityFlags uint32
+	ConstraintIndicatorFlags  uint64 // 48 bits
+	LevelIdc                  uint8
+
+	ChromaFormatIdc uint32 // 0 monochrome, 1 4:2:0, 2 4:2:2, 3 4:4:4
+
+	SeparateColourPlane bool
+	Width, Height       int // coded size
+	Conformance         Window
+	BitDepthLuma        int
+	BitDepthChroma      int
+
+	// VUI is nil if the SPS has no video usability information.
+	VUI *VUI
+}
+
+// DisplaySize returns the size of the picture within the conformance
+// window.
+func (s *SPS) DisplaySize() (int, int) {
+	w := s.Width - s.Conformance.Left - s.Conformance.Right
+	h := s.Height - s.Conformance.Top - s.Conformance.Bottom
+	return w, h
+}
+
+// ParseSPS parses a SPS NAL unit, including its two byte header.
+func ParseSPS(nal []byte) (*SPS, error) {
+	if NALUnitType(nal) != NALUnitSPS || len(nal) < 2 {
+		return nil, fmt.Errorf("%w: not a SPS NAL unit", ErrInvalid)
+	}
+	br := &bitReader{buf: unescape(nal[2:])}
+
+	s := &SPS{}
+	s.VPSID = uint8(br.u(4))
+	maxSubLayersMinus1 := int(br.u(3))
+	s.MaxSubLayers = maxSubLayersMinus1 + 1
+	s.TemporalIDNesting = br.flag()
+	s.parseProfileTierLevel(br, maxSubLayersMinus1)
+
+	s.ID = br.ue()
+	if s.ID > 15 {
+		return nil, fmt.Errorf("%w: sps_seq_parameter_set_id %d", ErrInvalid, s.ID)
+	}
+	s.ChromaFormatIdc = br.ue()
+	if s.ChromaFormatIdc > 3 {
+		return nil, fmt.Errorf("%w: chroma_format_idc %d", ErrInvalid, s.ChromaFormatIdc)
+	}
+	if s.ChromaFormatIdc == 3 {
+		s.SeparateColourPlane = br.flag()
+	}
+	s.Width = int(br.ue())
+	s.Height = int(br.ue())
+
+	if br.flag() { // conformance_window_flag
+		subWidth, subHeight := 1, 1
+		if !s.SeparateColourPlane {
+			if s.ChromaFormatIdc == 1 || s.ChromaFormatIdc == 2 {
+				subWidth = 2
+			}
+			if s.ChromaFormatIdc == 1 {
+				subHeight = 2
+			}
+		}
+		s.Conformance.Left = int(br.ue()) * subWidth
+		s.Conformance.Right = int(br.ue()) * subWidth
+		s.Conformance.Top = int(br.ue()) * subHeight
+		s.Conformance.Bottom = int(br.ue()) * subHeight
+	}
+
+	s.BitDepthLuma = int(br.ue()) + 8
+	s.BitDepthChroma = int(br.ue()) + 8
+	if s.BitDepthLuma > 16 || s.BitDepthChroma > 16 {
+		return nil, fmt.Errorf("%w: bit depth %d/%d", ErrInvalid, s.BitDepthLuma, s.BitDepthChroma)
+	}
+	if br.err != nil {
+		return nil, br.err
+	}
+	if w, h := s.DisplaySize(); w <= 0 || h <= 0 {
+		return nil, fmt.Errorf("%w: conformance window %+v of a %dx%d picture", ErrInvalid, s.Conformance, s.Width, s.Height)
+	}
+
+	// everything up to the VUI must be parsed to find it
+	log2MaxPocLsb := int(br.ue()) + 4
+	i := maxSubLayersMinus1
+	if br.flag() { // sps_sub_layer_ordering_info_present_flag
+		i = 0
+	}
+	for ; i <= maxSubLayersMinus1; i++ {
+		br.ue() // sps_max_dec_pic_buffering_minus1
+		br.ue() // sps_max_num_reorder_pics
+		br.ue() // sps_max_latency_increase_plus1
+	}
+	br.ue() // log2_min_luma_coding_block_size_minus3
+	br.ue() // log2_diff_max_min_luma_coding_block_size
+	br.ue() // log2_min_luma_transform_block_size_minus2
+	br.ue() // log2_diff_max_min_luma_transform_block_size
+	br.ue() // max_transform_hierarchy_depth_inter
+	br.ue() // max_transform_hierarchy_depth_intra
+	if br.flag() && br.flag() { // scaling_list_enabled_flag, sps_scaling_list_data_present_flag
+		skipScalingListData(br)
+	}
+	br.skip(1) // amp_enabled_flag
+	br.skip(1) // sample_adaptive_offset_enabled_flag
+	if br.flag() { // pcm_enabled_flag
+		br.skip(8) // pcm_sample_bit_depth_luma_minus1, pcm_sample_bit_depth_chroma_minus1
+		br.ue()    // log2_min_pcm_luma_coding_block_size_minus3
+		br.ue()    // log2_diff_max_min_pcm_luma_coding_block_size
+		br.skip(1) // pcm_loop_filter_disabled_flag
+	}
+	if err := skipShortTermRefPicSets(br); err != nil {
+		return nil, err
+	}
+	if br.flag() { // long_term_ref_pics_present_flag
+		n := br.ue()
+		if n > 32 {
+			return nil, fmt.Errorf("%w: num_long_term_ref_pics_sps %d", ErrInvalid, n)
+		}
+		for j := uint32(0); j < n; j++ {
+			br.skip(log2MaxPocLsb + 1) // lt_ref_pic_poc_lsb_sps, used_by_curr_pic_lt_sps_flag
+		}
+	}
+	br.skip(1) // sps_temporal_mvp_enabled_flag
+	br.skip(1) // strong_intra_smoothing_enabled_flag
+	if br.flag() { // vui_parameters_present_flag
+		s.VUI = parseVUI(br)
+	}
+
+	if br.err != nil {
+		return nil, br.err
+	}
+	return s, nil
+}
+
+func (s *SPS) parseProfileTierLevel(br *bitReader, maxSubLayersMinus1 int) {
+	s.ProfileSpace = uint8(br.u(2))
+	s.TierFlag = br.flag()
+	s.ProfileIdc = uint8(br.u(5))
+	s.ProfileCompatibilityFlags = br.u(32)
+	s.ConstraintIndicatorFlags = uint64(br.u(16))<<32 | uint64(br.u(32))
+	s.LevelIdc = uint8(br.u(8))
+
+	profilePresent := make([]bool, maxSubLayersMinus1)
+	levelPresent := make([]bool, maxSubLayersMinus1)
+	for i := 0; i < maxSubLayersMinus1; i++ {
+		profilePresent[i] = br.flag()
+		levelPresent[i] = br.flag()
+	}
+	if maxSubLayersMinus1 > 0 {
+		br.skip(2 * (8 - maxSubLayersMinus1)) // reserved_zero_2bits
+	}
+	for i := 0; i < maxSubLayersMinus1; i++ {
+		if profilePresent[i] {
+			br.skip(88)
+		}
+		if levelPresent[i] {
+			br.skip(8)
+		}
+	}
+}
+
+func skipScalingListData(br *bitReader) {
+	for sizeID := 0; sizeID < 4; sizeID++ {
+		step := 1
+		if sizeID == 3 {
+			step = 3
+		}
+		for matrixID := 0; matrixID < 6; matrixID += step {
+			if !br.flag() { // scaling_list_pred_mode_flag
+				br.ue() // scaling_list_pred_matrix_id_delta
+				continue
+			}
+			coefNum := 1 << uint(4+sizeID<<1)
+			if coefNum > 64 {
+				coefNum = 64
+			}
+			if sizeID > 1 {
+				br.se() // scaling_list_dc_coef_minus8
+			}
+			for i := 0; i < coefNum; i++ {
+				br.se() // scaling_list_delta_coef
+			}
+		}
+	}
+}
+
+// skipShortTermRefPicSets skips the st_ref_pic_set structures of a SPS,
+// which need the number of pictures of earlier sets to be parsed.
+func skipShortTermRefPicSets(br *bitReader) error {
+	num := br.ue() // num_short_term_ref_pic_sets
+	if num > 64 {
+		return fmt.Errorf("%w: num_short_term_ref_pic_sets %d", ErrInvalid, num)
+	}
+	numDeltaPocs := make([]uint32, num)
+	for idx := uint32(0); idx < num; idx++ {
+		if idx != 0 && br.flag() { // inter_ref_pic_set_prediction_flag
+			br.skip(1) // delta_rps_sign
+			br.ue()    // abs_delta_rps_minus1
+			ref := numDeltaPocs[idx-1]
+			for j := uint32(0); j <= ref; j++ {
+				used := br.flag() // used_by_curr_pic_flag
+				if used || br.flag() { // use_delta_flag
+					numDeltaPocs[idx]++
+				}
+			}
+			continue
+		}
+		neg, pos := br.ue(), br.ue()
+		if neg > 16 || pos > 16 {
+			return fmt.Errorf("%w: short term reference picture set of %d+%d pictures", ErrInvalid, neg, pos)
+		}
+		for j := uint32(0); j < neg+pos; j++ {
+			br.ue()    // delta_poc_s0_minus1 or delta_poc_s1_minus1
+			br.skip(1) // used_by_curr_pic_s0_flag or used_by_curr_pic_s1_flag
+		}
+		numDeltaPocs[idx] = neg + pos
+		if br.err != nil {
+			return br.err
+		}
+	}
+	return br.err
+}
+
+// parseVUI parses the VUI up to the colour description.
+func parseVUI(br *bitReader) *VUI {
+	v := &VUI{}
+	if br.flag() { // aspect_ratio_info_present_flag
+		v.AspectRatioIdc = uint8(br.u(8))
+		if v.AspectRatioIdc == 255 {
+			v.SarWidth = uint16(br.u(16))
+			v.SarHeight = uint16(br.u(16))
+		}
+	}
+	if br.flag() { // overscan_info_present_flag
+		br.skip(1) // overscan_appropriate_flag
+	}
+	if v.VideoSignalTypePresent = br.flag(); v.VideoSignalTypePresent {
+		v.VideoFormat = uint8(br.u(3))
+		v.VideoFullRange = br.flag()
+		if v.ColourDescription = br.flag(); v.ColourDescription {
+			v.ColourPrimaries = uint8(br.u(8))
+			v.TransferCharacteristics = uint8(br.u(8))
+			v.MatrixCoefficients = uint8(br.u(8))
+		}
+	}
+	return v
+}
@@ -0,0 +1,151 @@
+package hevc_test
+
+import (
+	"errors"
+	"math/bits"
+	"os"
+	"testing"
+
+	"github.com/jdeng/goheif/heif"
+	. "github.com/jdeng/goheif/hevc"
+)
+
+func TestParseSPS(t *testing.T) {
+	for _, tt := range []struct {
+		file          string
+		item          uint32
+		width, height int
+	}{
+		{"../testdata/camel.heic", 20002, 1596, 1064},
+		{"../heif/testdata/park.heic", 1, 512, 512},
+	} {
+		f, err := os.Open(tt.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+
+		it, err := heif.Open(f).ItemByID(tt.item)
+		if err != nil {
+			t.Fatalf("%s: ItemByID: %v", tt.file, err)
+		}
+		hvcc, ok := it.HevcConfig()
+		if !ok {
+			t.Fatalf("%s: item %d has no hvcC", tt.file, tt.item)
+		}
+		units := hvcc.NalUnits(NALUnitSPS)
+		if len(units) != 1 {
+			t.Fatalf("%s: %d SPS; want 1", tt.file, len(units))
+		}
+
+		sps, err := ParseSPS(units[0])
+		if err != nil {
+			t.Fatalf("%s: ParseSPS: %v", tt.file, err)
+		}
+		if w, h := sps.DisplaySize(); w != tt.width || h != tt.height {
+			t.Errorf("%s: DisplaySize = %dx%d; want %dx%d", tt.file, w, h, tt.width, tt.height)
+		}
+		config := hvcc.Config()
+		if sps.ChromaFormatIdc != uint32(config.ChromaFormat) {
+			t.Errorf("%s: ChromaFormatIdc = %d; hvcC has %d", tt.file, sps.ChromaFormatIdc, config.ChromaFormat)
+		}
+		if sps.BitDepthLuma != int(config.BitDepthLuma) || sps.BitDepthChroma != int(config.BitDepthChroma) {
+			t.Errorf("%s: bit depths = %d/%d; hvcC has %d/%d", tt.file, sps.BitDepthLuma, sps.BitDepthChroma, config.BitDepthLuma, config.BitDepthChroma)
+		}
+		if sps.ProfileIdc != config.GeneralProfileIdc || sps.LevelIdc != config.GeneralLevelIdc {
+			t.Errorf("%s: profile/level = %d/%d; hvcC has %d/%d", tt.file, sps.ProfileIdc, sps.LevelIdc, config.GeneralProfileIdc, config.GeneralLevelIdc)
+		}
+		if sps.ProfileCompatibilityFlags != config.GeneralProfileCompatibilityFlags || sps.ConstraintIndicatorFlags != config.GeneralConstraintIndicatorFlags {
+			t.Errorf("%s: profile flags = %#x/%#x; hvcC has %#x/%#x", tt.file, sps.ProfileCompatibilityFlags, sps.ConstraintIndicatorFlags, config.GeneralProfileCompatibilityFlags, config.GeneralConstraintIndicatorFlags)
+		}
+	}
+}
+
+// bitWriter writes the fields of an RBSP.
+type bitWriter struct {
+	buf []byte
+	n   int // in bits
+}
+
+func (w *bitWriter) u(n int, v uint32) {
+	for i := n - 1; i >= 0; i-- {
+		if w.n%8 == 0 {
+			w.buf = append(w.buf, 0)
+		}
+		w.buf[len(w.buf)-1] |= byte(v>>uint(i)&1) << (7 - uint(w.n%8))
+		w.n++
+	}
+}
+
+func (w *bitWriter) ue(v uint32) {
+	n := bits.Len32(v + 1)
+	w.u(n-1, 0)
+	w.u(n, v+1)
+}
+
+// testSPS returns a SPS of a 64x64 4:2:0 picture with the given
+// conformance window offsets, in chroma samples.
+func testSPS(left, right, top, bottom uint32) []byte {
+	w := &bitWriter{buf: []byte{0x42, 0x01}}
+	w.n = 16
+	w.u(4, 0)           // sps_video_parameter_set_id
+	w.u(3, 0)           // sps_max_sub_layers_minus1
+	w.u(1, 1)           // sps_temporal_id_nesting_flag
+	w.u(8, 1)           // general_profile_space, general_tier_flag, general_profile_idc
+	w.u(32, 0x60000000) // general_profile_compatibility_flags
+	w.u(16, 0x9000)     // general constraint flags
+	w.u(32, 0)
+	w.u(8, 90) // general_level_idc
+	w.ue(0)    // sps_seq_parameter_set_id
+	w.ue(1)    // chroma_format_idc
+	w.ue(64)   // pic_width_in_luma_samples
+	w.ue(64)   // pic_height_in_luma_samples
+	w.u(1, 1)  // conformance_window_flag
+	for _, v := range []uint32{left, right, top, bottom} {
+		w.ue(v)
+	}
+	w.ue(0)   // bit_depth_luma_minus8
+	w.ue(0)   // bit_depth_chroma_minus8
+	w.ue(0)   // log2_max_pic_order_cnt_lsb_minus4
+	w.u(1, 1) // sps_sub_layer_ordering_info_present_flag
+	for i := 0; i < 9; i++ {
+		w.ue(0) // sub layer ordering, block and transform sizes
+	}
+	w.u(4, 0) // scaling_list_enabled_flag, amp, sao, pcm_enabled_flag
+	w.ue(0)   // num_short_term_ref_pic_sets
+	w.u(4, 0) // long term, temporal mvp, strong intra smoothing, vui
+	w.u(1, 1) // rbsp_stop_one_bit
+	return w.buf
+}
+
+func TestParseSPSConformanceWindow(t *testing.T) {
+	for _, tt := range []struct {
+		left, right, top, bottom uint32
+		width, height            int // 0 if invalid
+	}{
+		{0, 2, 0, 4, 60, 56},
+		{16, 16, 0, 0, 0, 0},
+		{0, 0, 40, 0, 0, 0},
+	} {
+		sps, err := ParseSPS(testSPS(tt.left, tt.right, tt.top, tt.bottom))
+		if tt.width == 0 {
+			if !errors.Is(err, ErrInvalid) {
+				t.Errorf("ParseSPS with window %d,%d,%d,%d = %v; want ErrInvalid", tt.left, tt.right, tt.top, tt.bottom, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("ParseSPS with window %d,%d,%d,%d: %v", tt.left, tt.right, tt.top, tt.bottom, err)
+		}
+		if w, h := sps.DisplaySize(); w != tt.width || h != tt.height {
+			t.Errorf("DisplaySize with window %d,%d,%d,%d = %dx%d; want %dx%d", tt.left, tt.right, tt.top, tt.bottom, w, h, tt.width, tt.height)
+		}
+	}
+}
+
+func TestParseSPSTruncated(t *testing.T) {
+	// header, VPS id 0, one sub layer and the start of profile_tier_level
+	if _, err := ParseSPS([]byte{0x42, 0x01, 0x01, 0x01, 0x60}); err == nil {
+		t.Errorf("ParseSPS of a truncated SPS succeeded")
+	}
+}
@@ -0,0 +1,282 @@
+package libde265
+
+// #include <stdint.h>
+// #include "libde265/de265.h"
+//
+// extern int goGetBuffer(de265_decoder_context*, struct de265_image_spec*, struct de265_image*, void*);
+// extern void goReleaseBuffer(de265_decoder_context*, struct de265_image*, void*);
+//
+// static struct de265_image_allocation go_allocation = { goGetBuffer, goReleaseBuffer };
+//
+// static void* alloc_token(uintptr_t t) { return (void*)t; }
+//
+// static void set_go_allocation(de265_decoder_context* ctx, uintptr_t handle) {
+//   de265_set_image_allocation_functions(ctx, &go_allocation, (void*)handle);
+// }
+//
+// int default_get_buffer(de265_decoder_context* ctx, struct de265_image_spec* spec, struct de265_image* img) {
+//   return de265_get_default_image_allocation_functions()->get_buffer(ctx, spec, img, NULL);
+// }
+//
+// void default_release_buffer(de265_decoder_context* ctx, struct de265_image* img) {
+//   de265_get_default_image_allocation_functions()->release_buffer(ctx, img, NULL);
+// }
+import "C"
+
+import (
+	"image"
+	"runtime"
+	"runtime/cgo"
+	"sync"
+	"unsafe"
+)
+
+// PlanePadding is the slack libde265 may read past the end of a plane,
+// see SetTarget.
+const PlanePadding = 64
+
+// allocation is a picture decoded into Go memory. The planes stay pinned
+// while libde265 holds the picture.
+//
+// Allocations are found by the token set as the user data of their
+// planes, not by the de265_image: libde265 exchanges the planes of images,
+// e.g. with the output of the SAO filter, and releases the planes with
+// whichever image ends up holding them.
+type allocation struct {
+	pinner   runtime.Pinner
+	planes   [3][]byte
+	strides  [3]int
+	inTarget bool
+}
+
+type allocator struct {
+	handle cgo.Handle
+
+	mu        sync.Mutex
+	allocs    map[uintptr]*allocation // by token
+	nextToken uintptr
+	target    *image.YCbCr // for the next picture, see SetTarget
+	region    image.Rectangle
+}
+
+// WithGoAllocation makes libde265 decode into buffers allocated by Go
+// instead of its own. The pictures can then be used after the decoder
+// moves on without being copied, and SetTarget can place them in a
+// caller's image. Pictures with more than 8 bits per sample still use
+// libde265's buffers, as do those of decoders without worker threads,
+// for which libde265 ignores the allocation functions; the option has no
+// effect for them, and their pictures are copied into Go memory by
+// Picture.Detach.
+func WithGoAllocation(b bool) Option {
+	return func(dec *Decoder) {
+		dec.goAlloc = b
+	}
+}
+
+func (dec *Decoder) initAllocation() {
+	a := &allocator{allocs: make(map[uintptr]*allocation)}
+	a.handle = cgo.NewHandle(a)
+	dec.alloc = a
+	C.set_go_allocation(dec.ctx, C.uintptr_t(a.handle))
+}
+
+// freeAllocation must be called once the decoder was freed, when libde265
+// released all pictures.
+func (dec *Decoder) freeAllocation() {
+	if dec.alloc != nil {
+		dec.alloc.handle.Delete()
+		dec.alloc = nil
+	}
+}
+
+// SetTarget makes the next picture decode directly into the region r of
+// dst, whose planes must stay untouched until the picture is complete.
+// This requires a decoder using WithGoAllocation, a picture of the same
+// subsample ratio whose coded size fits into r, and plane offsets and
+// strides aligned as libde265 requires. Otherwise the picture is decoded
+// into a buffer of its own, which Picture.InTarget reports.
+//
+// The plane slices of dst need PlanePadding bytes of capacity beyond the
+// last sample, which image.NewYCbCr does not provide for Cr.
+func (dec *Decoder) SetTarget(dst *image.YCbCr, r image.Rectangle) {
+	if dec.alloc == nil {
+		return
+	}
+	dec.alloc.mu.Lock()
+	defer dec.alloc.mu.Unlock()
+	dec.alloc.target, dec.alloc.region = dst, r
+}
+
+// picture returns the image of a picture decoded into Go memory.
+func (a *allocator) picture(img *C.struct_de265_image) (*image.YCbCr, bool, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.target = nil // only for the next picture
+
+	alloc, ok := a.allocs[planeToken(img)]
+	if !ok {
+		return nil, false, false
+	}
+
+	width := int(C.de265_get_image_width(img, 0))
+	height := int(C.de265_get_image_height(img, 0))
+	ycc := &image.YCbCr{
+		YStride:        alloc.strides[0],
+		CStride:        alloc.strides[1],
+		SubsampleRatio: subsampleRatio(C.de265_get_chroma_format(img)),
+		Rect:           image.Rect(0, 0, width, height),
+	}
+	cheight := int(C.de265_get_image_height(img, 1))
+
+	// the planes may start at an offset into the buffers, e.g. for cropping
+	var stride C.int
+	off := func(c int) int {
+		p := C.de265_get_image_plane(img, C.int(c), &stride)
+		return int(uintptr(unsafe.Pointer(p)) - uintptr(unsafe.Pointer(&alloc.planes[c][0])))
+	}
+	y, cb, cr := off(0), off(1), off(2)
+	ycc.Y = alloc.planes[0][y : y+(height-1)*ycc.YStride+width]
+	cw, _ := chromaSize(width, height, ycc.SubsampleRatio)
+	ycc.Cb = alloc.planes[1][cb : cb+(cheight-1)*ycc.CStride+cw]
+	ycc.Cr = alloc.planes[2][cr : cr+(cheight-1)*ycc.CStride+cw]
+	return ycc, alloc.inTarget, true
+}
+
+// getBuffer allocates the planes of a picture, see goGetBuffer.
+func (a *allocator) getBuffer(spec *C.struct_de265_image_spec, img *C.struct_de265_image) bool {
+	var ratio image.YCbCrSubsampleRatio
+	switch spec.format {
+	case C.de265_image_format_YUV420P8:
+		ratio = image.YCbCrSubsampleRatio420
+	case C.de265_image_format_YUV422P8:
+		ratio = image.YCbCrSubsampleRatio422
+	case C.de265_image_format_YUV444P8:
+		ratio = image.YCbCrSubsampleRatio444
+	default:
+		return false
+	}
+	for c := 0; c < 3; c++ {
+		if C.de265_get_bits_per_pixel(img, C.int(c)) != 8 {
+			return false
+		}
+	}
+
+	width, height, align := int(spec.width), int(spec.height), int(spec.alignment)
+	if align < 1 {
+		align = 1
+	}
+	cw, ch := chromaSize(width, height, ratio)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	alloc := &allocation{}
+	if planes, strides, ok := a.targetPlanes(width, height, ratio, align); ok {
+		alloc.planes, alloc.strides, alloc.inTarget = planes, strides, true
+	} else {
+		alloc.strides[0] = alignUp(width, align)
+		alloc.strides[1] = alignUp(cw, align)
+		alloc.strides[2] = alloc.strides[1]
+		alloc.planes[0] = alignedBytes(alloc.strides[0]*height, align)
+		alloc.planes[1] = alignedBytes(alloc.strides[1]*ch, align)
+		alloc.planes[2] = alignedBytes(alloc.strides[2]*ch, align)
+	}
+	a.target = nil
+
+	a.nextToken++
+	token := C.alloc_token(C.uintptr_t(a.nextToken))
+	for c, p := range alloc.planes {
+		alloc.pinner.Pin(&p[0])
+		C.de265_set_image_plane(img, C.int(c), unsafe.Pointer(&p[0]), C.int(alloc.strides[c]), token)
+	}
+	a.allocs[a.nextToken] = alloc
+	return true
+}
+
+// targetPlanes returns the planes of the target region, if a picture of
+// the given coded size can be decoded into it.
+func (a *allocator) targetPlanes(width, height int, ratio image.YCbCrSubsampleRatio, align int) (planes [3][]byte, strides [3]int, ok bool) {
+	dst, r := a.target, a.region
+	if dst == nil || dst.SubsampleRatio != ratio || !r.In(dst.Rect) || width > r.Dx() || height > r.Dy() {
+		return planes, strides, false
+	}
+	if dst.YStride%align != 0 || dst.CStride%align != 0 {
+		return planes, strides, false
+	}
+
+	cw, ch := chromaSize(width, height, ratio)
+	yoff, coff := dst.YOffset(r.Min.X, r.Min.Y), dst.COffset(r.Min.X, r.Min.Y)
+	planes[0] = dst.Y[yoff:]
+	planes[1] = dst.Cb[coff:]
+	planes[2] = dst.Cr[coff:]
+	strides = [3]int{dst.YStride, dst.CStride, dst.CStride}
+	for c, p := range planes {
+		w, h := width, height
+		if c > 0 {
+			w, h = cw, ch
+		}
+		if len(p) == 0 || uintptr(unsafe.Pointer(&p[0]))%uintptr(align) != 0 {
+			return planes, strides, false
+		}
+		if end := (h-1)*strides[c] + w; end > len(p) || end+PlanePadding > cap(p) {
+			return planes, strides, false
+		}
+	}
+	return planes, strides, true
+}
+
+// releaseBuffer unpins the planes of a picture, see goReleaseBuffer.
+func (a *allocator) releaseBuffer(img *C.struct_de265_image) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	token := planeToken(img)
+	alloc, ok := a.allocs[token]
+	if !ok {
+		return false
+	}
+	alloc.pinner.Unpin()
+	delete(a.allocs, token)
+	return true
+}
+
+// planeToken returns the token of the allocation holding the planes of
+// img, or 0 for planes allocated by libde265.
+func planeToken(img *C.struct_de265_image) uintptr {
+	return uintptr(C.de265_get_image_plane_user_data(img, 0))
+}
+
+func alignUp(n, align int) int {
+	return (n + align - 1) / align * align
+}
+
+// alignedBytes returns n bytes, plus padding, starting at an address that
+// is a multiple of align.
+func alignedBytes(n, align int) []byte {
+	buf := make([]byte, n+align+PlanePadding)
+	off := 0
+	if m := int(uintptr(unsafe.Pointer(&buf[0])) % uintptr(align)); m != 0 {
+		off = align - m
+	}
+	return buf[off : off+n]
+}
+
+// chromaSize returns the size of the chroma planes of a picture.
+func chromaSize(width, height int, ratio image.YCbCrSubsampleRatio) (int, int) {
+	switch ratio {
+	case image.YCbCrSubsampleRatio420:
+		return (width + 1) / 2, (height + 1) / 2
+	case image.YCbCrSubsampleRatio422:
+		return (width + 1) / 2, height
+	}
+	return width, height
+}
+
+func subsampleRatio(chroma C.enum_de265_chroma) image.YCbCrSubsampleRatio {
+	switch chroma {
+	case C.de265_chroma_420:
+		return image.YCbCrSubsampleRatio420
+	case C.de265_chroma_422:
+		return image.YCbCrSubsampleRatio422
+	}
+	return image.YCbCrSubsampleRatio444
+}
@@ -0,0 +1,32 @@
+package libde265
+
+// #include "libde265/de265.h"
+//
+// int default_get_buffer(de265_decoder_context* ctx, struct de265_image_spec* spec, struct de265_image* img);
+// void default_release_buffer(de265_decoder_context* ctx, struct de265_image* img);
+import "C"
+
+import (
+	"runtime/cgo"
+	"unsafe"
+)
+
+// The callbacks of the image allocation functions set by WithGoAllocation.
+// userdata is the cgo.Handle of the decoder's allocator.
+
+//export goGetBuffer
+func goGetBuffer(ctx unsafe.Pointer, spec *C.struct_de265_image_spec, img *C.struct_de265_image, userdata unsafe.Pointer) C.int {
+	a := cgo.Handle(userdata).Value().(*allocator)
+	if a.getBuffer(spec, img) {
+		return 1
+	}
+	return C.default_get_buffer(ctx, spec, img)
+}
+
+//export goReleaseBuffer
+func goReleaseBuffer(ctx unsafe.Pointer, img *C.struct_de265_image, userdata unsafe.Pointer) {
+	a := cgo.Handle(userdata).Value().(*allocator)
+	if !a.releaseBuffer(img) {
+		C.default_release_buffer(ctx, img)
+	}
+}
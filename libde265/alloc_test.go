@@ -0,0 +1,30 @@
+package libde265
+
+import "testing"
+
+func TestGoAllocation(t *testing.T) {
+	stream := testStream(t)
+	want := decodeStream(t, stream, WithSafeEncoding(true)).Image()
+
+	// libde265 only allocates through Go with worker threads, and may
+	// then exchange the planes of a picture with those of another
+	for _, opts := range [][]Option{
+		{WithGoAllocation(true)},
+		{WithGoAllocation(true), WithThreads(4)},
+		{WithGoAllocation(true), WithThreads(4), WithDisableSAO(true), WithDisableDeblocking(true)},
+	} {
+		for i := 0; i < 3; i++ {
+			pic := decodeStream(t, stream, opts...)
+			if len(opts) > 2 {
+				// without the filters, the picture only matches in size
+				if got := pic.Image().Rect; got != want.Rect {
+					t.Errorf("picture %d with %d options: bounds %v; want %v", i, len(opts), got, want.Rect)
+				}
+				continue
+			}
+			if !sameLuma(pic.Image(), want) {
+				t.Errorf("picture %d with %d options differs", i, len(opts))
+			}
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package libde265
+
+// #include "libde265/de265.h"
+import "C"
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrCodec is wrapped by every failure reported by libde265 itself,
+	// see Error.
+	ErrCodec = errors.New("libde265: codec error")
+
+	// ErrInvalidNAL is returned for malformed length-prefixed NAL data.
+	ErrInvalidNAL = errors.New("libde265: invalid NAL data")
+
+	// ErrNoPicture is returned when the data did not decode to a picture.
+	ErrNoPicture = errors.New("libde265: no picture")
+
+	// ErrImageTooBig is returned for pictures too large to be addressed.
+	ErrImageTooBig = errors.New("libde265: image too big")
+
+	// ErrChecksumMismatch is wrapped by the error returned when a decoded
+	// picture does not match its decoded picture hash SEI message, see
+	// WithHashVerification.
+	ErrChecksumMismatch = errors.New("libde265: decoded picture hash mismatch")
+
+	// ErrUnsupported is wrapped by errors for bitstreams using features
+	// libde265 does not implement, such as some range extensions.
+	ErrUnsupported = errors.New("libde265: unsupported bitstream feature")
+
+	// ErrTruncated is wrapped by errors for bitstreams that end early,
+	// such as a slice cut off in the middle.
+	ErrTruncated = errors.New("libde265: truncated bitstream")
+
+	// ErrInvalidBitstream is wrapped by errors for malformed bitstreams.
+	ErrInvalidBitstream = errors.New("libde265: invalid bitstream")
+)
+
+// Code is a de265_error value. Codes from CodeWarningNoWPP on are
+// warnings, but libde265 reports some codes below that, such as
+// CodeChecksumMismatch, as warnings too.
+type Code int
+
+const (
+	CodeOK                             Code = 0
+	CodeNoSuchFile                     Code = 1
+	CodeCoefficientOutOfImageBounds    Code = 4
+	CodeChecksumMismatch               Code = 5
+	CodeCTBOutsideImageArea            Code = 6
+	CodeOutOfMemory                    Code = 7
+	CodeCodedParameterOutOfRange       Code = 8
+	CodeImageBufferFull                Code = 9
+	CodeCannotStartThreadpool          Code = 10
+	CodeLibraryInitializationFailed    Code = 11
+	CodeLibraryNotInitialized          Code = 12
+	CodeWaitingForInputData            Code = 13
+	CodeCannotProcessSEI               Code = 14
+	CodeParameterParsing               Code = 15
+	CodeNoInitialSliceHeader           Code = 16
+	CodePrematureEndOfSlice            Code = 17
+	CodeUnspecifiedDecodingError       Code = 18
+	CodeNotImplementedYet              Code = 502
+	CodeWarningNoWPP                   Code = 1000
+	CodeWarningBufferFull              Code = 1001
+	CodeWarningPrematureEndOfSlice     Code = 1002
+	CodeWarningIncorrectEntryPoint     Code = 1003
+	CodeWarningCTBOutsideImageArea     Code = 1004
+	CodeWarningSPSHeaderInvalid        Code = 1005
+	CodeWarningPPSHeaderInvalid        Code = 1006
+	CodeWarningSliceHeaderInvalid      Code = 1007
+	CodeWarningNonexistingPPS          Code = 1009
+	CodeWarningNonexistingSPS          Code = 1010
+	CodeWarningEOSSBitNotSet           Code = 1017
+	CodeWarningInvalidChromaFormat     Code = 1019
+	CodeWarningSliceAddressInvalid     Code = 1020
+	CodeWarningThreadsLimited          Code = 1022
+	CodeWarningSAOOutOfMemory          Code = 1024
+	CodeWarningPCMBitDepthTooLarge     Code = 1027
+	CodeWarningBitDepthMismatch        Code = 1031
+	CodeWarningInvalidSliceHeaderIndex Code = 1033
+)
+
+// IsWarning reports whether the code is in libde265's warning range.
+func (c Code) IsWarning() bool {
+	return c >= CodeWarningNoWPP
+}
+
+// Text returns libde265's description of the code.
+func (c Code) Text() string {
+	return C.GoString(C.de265_get_error_text(C.de265_error(c)))
+}
+
+// class returns the sentinel error classifying the code, if any.
+func (c Code) class() error {
+	switch c {
+	case CodeChecksumMismatch:
+		return ErrChecksumMismatch
+	case CodeNotImplementedYet, CodeWarningInvalidChromaFormat, CodeWarningPCMBitDepthTooLarge:
+		return ErrUnsupported
+	case CodeWaitingForInputData, CodeNoInitialSliceHeader, CodePrematureEndOfSlice,
+		CodeWarningPrematureEndOfSlice, CodeWarningEOSSBitNotSet:
+		return ErrTruncated
+	case CodeCoefficientOutOfImageBounds, CodeCTBOutsideImageArea, CodeCodedParameterOutOfRange,
+		CodeParameterParsing, CodeUnspecifiedDecodingError,
+		CodeWarningIncorrectEntryPoint, CodeWarningCTBOutsideImageArea,
+		CodeWarningSPSHeaderInvalid, CodeWarningPPSHeaderInvalid, CodeWarningSliceHeaderInvalid,
+		CodeWarningNonexistingPPS, CodeWarningNonexistingSPS, CodeWarningSliceAddressInvalid,
+		CodeWarningBitDepthMismatch, CodeWarningInvalidSliceHeaderIndex:
+		return ErrInvalidBitstream
+	}
+	return nil
+}
+
+// Error is a failure reported by a libde265 function. Errors are always
+// fatal to the decode; non-fatal problems are reported as Warnings. An
+// Error wraps ErrCodec, and one of ErrChecksumMismatch, ErrUnsupported,
+// ErrTruncated or ErrInvalidBitstream depending on its code.
+type Error struct {
+	Op   string // the libde265 function, e.g. "de265_decode"
+	Code Code   // the de265_error it returned
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("libde265: %s: %s (%d)", e.Op, e.Code.Text(), e.Code)
+}
+
+// Is reports whether target is ErrCodec or the class of the error's code.
+func (e *Error) Is(target error) bool {
+	if target == ErrCodec {
+		return true
+	}
+	class := e.Code.class()
+	return class != nil && target == class
+}
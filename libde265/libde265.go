@@ -7,36 +7,140 @@ package libde265
 import "C"
 
 import (
-	"fmt"
+	"context"
+	"errors"
 	"image"
+	"sync"
 	"unsafe"
 )
 
+// Warning is a non-fatal problem reported while decoding. Its code need
+// not be in the warning range, see Code.IsWarning.
+type Warning struct {
+	Code Code
+	Text string
+}
+
+func (w Warning) String() string {
+	return w.Text
+}
+
 type Decoder struct {
 	ctx        unsafe.Pointer
-	hasImage   bool
+	picture    *pictureState // not yet handed back to libde265
 	safeEncode bool
+	threads    int
+	verifyHash bool
+	noDeblock  bool
+	noSAO      bool
+	goAlloc    bool
+	alloc      *allocator // with goAlloc, see alloc.go
+	onWarning  func(Warning)
+	warnings   []Warning // since the last Reset
+
+	// Streaming state, see stream.go:
+	flushed   bool
+	userData  map[uintptr]interface{} // by token passed to libde265
+	nextToken uintptr
 }
 
-func Init() {
-	C.de265_init()
+// lib counts the references to libde265's global state, held by Init
+// and by every decoder.
+var lib struct {
+	sync.Mutex
+	refs  int
+	inits int // of refs, taken by Init
+}
+
+func acquire() error {
+	lib.Lock()
+	defer lib.Unlock()
+	if lib.refs == 0 {
+		if ret := C.de265_init(); ret != C.DE265_OK {
+			return &Error{Op: "de265_init", Code: Code(ret)}
+		}
+	}
+	lib.refs++
+	return nil
 }
 
+func release() {
+	lib.Lock()
+	defer lib.Unlock()
+	if lib.refs == 0 {
+		return
+	}
+	lib.refs--
+	if lib.refs == 0 {
+		C.de265_free()
+	}
+}
+
+// Init takes a reference to libde265's global state, initializing it if
+// needed. Calling it is optional, as every decoder holds a reference of
+// its own; it only keeps the state alive between decoders.
+func Init() error {
+	if err := acquire(); err != nil {
+		return err
+	}
+	lib.Lock()
+	lib.inits++
+	lib.Unlock()
+	return nil
+}
+
+// Fini drops a reference taken by Init. The global state is freed once
+// the last reference is gone, so it is safe to call while decoders are
+// in use; extra calls are ignored.
 func Fini() {
-	C.de265_free()
+	lib.Lock()
+	if lib.inits == 0 {
+		lib.Unlock()
+		return
+	}
+	lib.inits--
+	lib.Unlock()
+	release()
 }
 
 func NewDecoder(opts ...Option) (*Decoder, error) {
+	if err := acquire(); err != nil {
+		return nil, err
+	}
+
 	p := C.de265_new_decoder()
 	if p == nil {
-		return nil, fmt.Errorf("Unable to create decoder")
+		release()
+		return nil, errors.New("libde265: unable to create decoder")
 	}
 
-	dec := &Decoder{ctx: p, hasImage: false}
+	dec := &Decoder{ctx: p}
 	for _, opt := range opts {
 		opt(dec)
 	}
 
+	if dec.verifyHash {
+		C.de265_set_parameter_bool(p, C.DE265_DECODER_PARAM_BOOL_SEI_CHECK_HASH, 1)
+	}
+	if dec.noDeblock {
+		C.de265_set_parameter_bool(p, C.DE265_DECODER_PARAM_DISABLE_DEBLOCKING, 1)
+	}
+	if dec.noSAO {
+		C.de265_set_parameter_bool(p, C.DE265_DECODER_PARAM_DISABLE_SAO, 1)
+	}
+	if dec.goAlloc {
+		dec.initAllocation()
+	}
+
+	if dec.threads > 0 {
+		if ret := C.de265_start_worker_threads(p, C.int(dec.threads)); ret != C.DE265_OK {
+			C.de265_free_decoder(p)
+			dec.freeAllocation()
+			release()
+			return nil, &Error{Op: "de265_start_worker_threads", Code: Code(ret)}
+		}
+	}
+
 	return dec, nil
 }
 
@@ -48,119 +152,162 @@ func WithSafeEncoding(b bool) Option {
 	}
 }
 
-func (dec *Decoder) Free() {
-	dec.Reset()
-	C.de265_free_decoder(dec.ctx)
+// WithThreads starts n worker threads for libde265's own parallel
+// decoding of WPP substreams and tiles. The threads are started by
+// NewDecoder and stopped by Free. The default, 0, decodes on the calling
+// thread only.
+func WithThreads(n int) Option {
+	return func(dec *Decoder) {
+		dec.threads = n
+	}
 }
 
-func (dec *Decoder) Reset() {
-	if dec.ctx != nil && dec.hasImage {
-		C.de265_release_next_picture(dec.ctx)
-		dec.hasImage = false
+// WithHashVerification makes libde265 check every decoded picture against
+// the MD5, CRC or checksum carried in its decoded picture hash SEI
+// message. A mismatch fails the decode with an error wrapping
+// ErrChecksumMismatch. Pictures without such a message are not checked.
+func WithHashVerification(b bool) Option {
+	return func(dec *Decoder) {
+		dec.verifyHash = b
 	}
+}
 
-	C.de265_reset(dec.ctx)
+// WithDisableDeblocking skips the deblocking filter. Decoding gets faster
+// at the cost of visible block edges; pictures no longer match the
+// encoder's output, so hash verification will fail.
+func WithDisableDeblocking(b bool) Option {
+	return func(dec *Decoder) {
+		dec.noDeblock = b
+	}
 }
 
-func (dec *Decoder) Push(data []byte) error {
-	var pos int
-	totalSize := len(data)
-	for pos < totalSize {
-		if pos+4 > totalSize {
-			return fmt.Errorf("Invalid NAL data")
-		}
+// WithDisableSAO skips the sample adaptive offset filter, trading some
+// quality for speed like WithDisableDeblocking.
+func WithDisableSAO(b bool) Option {
+	return func(dec *Decoder) {
+		dec.noSAO = b
+	}
+}
 
-		nalSize := uint32(data[pos])<<24 | uint32(data[pos+1])<<16 | uint32(data[pos+2])<<8 | uint32(data[pos+3])
-		pos += 4
+// WithWarningHandler sets a function called with every warning as it is
+// reported. Warnings are also collected, see Warnings.
+func WithWarningHandler(fn func(Warning)) Option {
+	return func(dec *Decoder) {
+		dec.onWarning = fn
+	}
+}
 
-		if pos+int(nalSize) > totalSize {
-			return fmt.Errorf("Invalid NAL size: %d", nalSize)
-		}
+// Warnings returns the warnings reported since the last Reset.
+func (dec *Decoder) Warnings() []Warning {
+	return dec.warnings
+}
 
-		C.de265_push_NAL(dec.ctx, unsafe.Pointer(&data[pos]), C.int(nalSize), C.de265_PTS(0), nil)
-		pos += int(nalSize)
+func (dec *Decoder) warn(w Warning) {
+	dec.warnings = append(dec.warnings, w)
+	if dec.onWarning != nil {
+		dec.onWarning(w)
 	}
+}
 
-	return nil
+// Free frees the decoder and drops its reference to the global state.
+// Freeing a decoder twice is a no-op.
+func (dec *Decoder) Free() {
+	if dec.ctx == nil {
+		return
+	}
+	dec.Reset()
+	C.de265_free_decoder(dec.ctx)
+	dec.ctx = nil
+	dec.freeAllocation()
+	release()
+}
+
+func (dec *Decoder) Reset() {
+	dec.releasePicture()
+
+	C.de265_reset(dec.ctx)
+	dec.warnings = nil
+	dec.flushed = false
+	dec.userData = nil
+}
+
+// Push pushes NAL units, each preceded by a 4 byte big-endian length,
+// such as the parameter sets from an hvcC box or the data of an item.
+func (dec *Decoder) Push(data []byte) error {
+	return dec.PushLengthPrefixed(data, 4, 0, nil)
 }
 
 func (dec *Decoder) DecodeImage(data []byte) (image.Image, error) {
-	if dec.hasImage {
-		fmt.Printf("previous image may leak")
+	return dec.DecodeImageContext(context.Background(), data)
+}
+
+// DecodeImageContext is like DecodeImage but gives up with ctx.Err() once
+// ctx is done, see DecodePicture. The image stays valid after the decoder
+// moves on, at the cost of a copy unless it is in Go memory already.
+func (dec *Decoder) DecodeImageContext(ctx context.Context, data []byte) (image.Image, error) {
+	pic, err := dec.DecodePicture(ctx, data)
+	if err != nil {
+		return nil, err
 	}
+	img := pic.Detach()
+	pic.Release()
+	return img, nil
+}
 
-	if len(data) > 0 {
-		if err := dec.Push(data); err != nil {
-			return nil, err
+// collectWarnings records the pending warnings of the decoder. With hash
+// verification, a checksum mismatch is returned as an error.
+func (dec *Decoder) collectWarnings() error {
+	var mismatch bool
+	for {
+		warning := C.de265_get_warning(dec.ctx)
+		if warning == C.DE265_OK {
+			break
+		}
+		dec.warn(Warning{Code: Code(warning), Text: C.GoString(C.de265_get_error_text(warning))})
+		if Code(warning) == CodeChecksumMismatch {
+			mismatch = true
 		}
 	}
 
-	if ret := C.de265_flush_data(dec.ctx); ret != C.DE265_OK {
-		return nil, fmt.Errorf("flush_data error")
+	if mismatch && dec.verifyHash {
+		return &Error{Op: "de265_decode", Code: CodeChecksumMismatch}
 	}
+	return nil
+}
 
-	var more C.int = 1
-	for more != 0 {
-		if decerr := C.de265_decode(dec.ctx, &more); decerr != C.DE265_OK {
-			return nil, fmt.Errorf("decode error")
-		}
+// toYCbCr copies the planes of a decoded picture into Go memory, or only
+// wraps them when copy is false.
+func toYCbCr(img *C.struct_de265_image, copy bool) (*image.YCbCr, error) {
+	width := C.de265_get_image_width(img, 0)
+	height := C.de265_get_image_height(img, 0)
 
-		for {
-			warning := C.de265_get_warning(dec.ctx)
-			if warning == C.DE265_OK {
-				break
-			}
-			fmt.Printf("warning: %v\n", C.GoString(C.de265_get_error_text(warning)))
-		}
+	var ystride, cstride C.int
+	y := C.de265_get_image_plane(img, 0, &ystride)
+	cb := C.de265_get_image_plane(img, 1, &cstride)
+	cheight := C.de265_get_image_height(img, 1)
+	cr := C.de265_get_image_plane(img, 2, &cstride)
+	//			crh := C.de265_get_image_height(img, 2)
 
-		if img := C.de265_get_next_picture(dec.ctx); img != nil {
-			dec.hasImage = true // lazy release
-
-			width := C.de265_get_image_width(img, 0)
-			height := C.de265_get_image_height(img, 0)
-
-			var ystride, cstride C.int
-			y := C.de265_get_image_plane(img, 0, &ystride)
-			cb := C.de265_get_image_plane(img, 1, &cstride)
-			cheight := C.de265_get_image_height(img, 1)
-			cr := C.de265_get_image_plane(img, 2, &cstride)
-			//			crh := C.de265_get_image_height(img, 2)
-
-			// sanity check
-			if int(height)*int(ystride) >= int(1<<30) {
-				return nil, fmt.Errorf("image too big")
-			}
-
-			var r image.YCbCrSubsampleRatio
-			switch chroma := C.de265_get_chroma_format(img); chroma {
-			case C.de265_chroma_420:
-				r = image.YCbCrSubsampleRatio420
-			case C.de265_chroma_422:
-				r = image.YCbCrSubsampleRatio422
-			case C.de265_chroma_444:
-				r = image.YCbCrSubsampleRatio444
-			}
-			ycc := &image.YCbCr{
-				YStride:        int(ystride),
-				CStride:        int(cstride),
-				SubsampleRatio: r,
-				Rect:           image.Rectangle{Min: image.Point{0, 0}, Max: image.Point{int(width), int(height)}},
-			}
-			if dec.safeEncode {
-				ycc.Y = C.GoBytes(unsafe.Pointer(y), C.int(height*ystride))
-				ycc.Cb = C.GoBytes(unsafe.Pointer(cb), C.int(cheight*cstride))
-				ycc.Cr = C.GoBytes(unsafe.Pointer(cr), C.int(cheight*cstride))
-			} else {
-				ycc.Y = (*[1 << 30]byte)(unsafe.Pointer(y))[:int(height)*int(ystride)]
-				ycc.Cb = (*[1 << 30]byte)(unsafe.Pointer(cb))[:int(cheight)*int(cstride)]
-				ycc.Cr = (*[1 << 30]byte)(unsafe.Pointer(cr))[:int(cheight)*int(cstride)]
-			}
-
-			//C.de265_release_next_picture(dec.ctx)
-
-			return ycc, nil
-		}
+	// sanity check
+	if int(height)*int(ystride) >= int(1<<30) {
+		return nil, ErrImageTooBig
+	}
+
+	ycc := &image.YCbCr{
+		YStride:        int(ystride),
+		CStride:        int(cstride),
+		SubsampleRatio: subsampleRatio(C.de265_get_chroma_format(img)),
+		Rect:           image.Rectangle{Min: image.Point{0, 0}, Max: image.Point{int(width), int(height)}},
+	}
+	if copy {
+		ycc.Y = C.GoBytes(unsafe.Pointer(y), C.int(height*ystride))
+		ycc.Cb = C.GoBytes(unsafe.Pointer(cb), C.int(cheight*cstride))
+		ycc.Cr = C.GoBytes(unsafe.Pointer(cr), C.int(cheight*cstride))
+	} else {
+		ycc.Y = (*[1 << 30]byte)(unsafe.Pointer(y))[:int(height)*int(ystride)]
+		ycc.Cb = (*[1 << 30]byte)(unsafe.Pointer(cb))[:int(cheight)*int(cstride)]
+		ycc.Cr = (*[1 << 30]byte)(unsafe.Pointer(cr))[:int(cheight)*int(cstride)]
 	}
 
-	return nil, fmt.Errorf("No picture")
+	return ycc, nil
 }
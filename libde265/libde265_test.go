@@ -0,0 +1,228 @@
+package libde265
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"errors"
+	"image"
+	"os"
+	"runtime"
+	"testing"
+
+	"github.com/jdeng/goheif/heif"
+	"github.com/jdeng/goheif/hevc"
+)
+
+// testStream returns the primary image of testdata/camel.heic as an
+// Annex-B byte stream.
+func testStream(t *testing.T) []byte {
+	t.Helper()
+	f, err := os.Open("../testdata/camel.heic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	hf := heif.Open(f)
+	it, err := hf.PrimaryItem()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream, err := hf.AnnexB(it)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stream
+}
+
+// decodeStream decodes the first picture of an Annex-B stream.
+func decodeStream(t *testing.T, stream []byte, opts ...Option) *Picture {
+	t.Helper()
+	dec, err := NewDecoder(opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(dec.Free)
+	if err := dec.PushData(stream, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	pic, err := dec.DecodePicture(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pic
+}
+
+// sameLuma reports whether the visible luma samples of a and b are equal.
+func sameLuma(a, b *image.YCbCr) bool {
+	if a.Rect != b.Rect {
+		return false
+	}
+	w := a.Rect.Dx()
+	for y := a.Rect.Min.Y; y < a.Rect.Max.Y; y++ {
+		ao, bo := a.YOffset(a.Rect.Min.X, y), b.YOffset(b.Rect.Min.X, y)
+		if !bytes.Equal(a.Y[ao:ao+w], b.Y[bo:bo+w]) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestDecodeImage(t *testing.T) {
+	stream := testStream(t)
+	dec, err := NewDecoder()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dec.Free()
+	if err := dec.PushData(stream, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	img, err := dec.DecodeImage(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := decodeStream(t, stream, WithSafeEncoding(true)).Image()
+
+	// the image outlives the decoder's buffers
+	dec.Free()
+	runtime.GC()
+	if !sameLuma(img.(*image.YCbCr), want) {
+		t.Errorf("image differs after the decoder was freed")
+	}
+}
+
+func TestFiniDuringDecode(t *testing.T) {
+	stream := testStream(t)
+	want := decodeStream(t, stream, WithSafeEncoding(true)).Image()
+
+	if err := Init(); err != nil {
+		t.Fatal(err)
+	}
+	dec, err := NewDecoder()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dec.Free()
+	if err := dec.PushData(stream, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// more calls than of Init must not free the state the decoder uses
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 3; i++ {
+			Fini()
+		}
+	}()
+	img, err := dec.DecodeImage(nil)
+	<-done
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sameLuma(img.(*image.YCbCr), want) {
+		t.Errorf("image differs from that of another decoder")
+	}
+
+	lib.Lock()
+	refs, inits := lib.refs, lib.inits
+	lib.Unlock()
+	if inits != 0 || refs < 1 {
+		t.Errorf("after Fini: %d references, %d by Init; want those of the decoders only", refs, inits)
+	}
+}
+
+// hashSEI returns a suffix SEI NAL unit with the MD5 decoded picture hash
+// of the picture of an Annex-B stream of 8 bit 4:2:0.
+func hashSEI(t *testing.T, stream []byte) []byte {
+	t.Helper()
+	var sps *hevc.SPS
+	for _, nal := range splitAnnexB(stream) {
+		if hevc.NALUnitType(nal) == hevc.NALUnitSPS {
+			var err error
+			if sps, err = hevc.ParseSPS(nal); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if sps == nil || sps.Conformance.Left != 0 || sps.Conformance.Top != 0 {
+		t.Fatalf("SPS %+v; want one cropping at the right and bottom only", sps)
+	}
+
+	// The hash covers the whole coded picture. libde265's planes of the
+	// visible picture start with it, and the slices of the picture in
+	// its buffers may be extended beyond the visible size.
+	img := decodeStream(t, stream).Image()
+	payload := []byte{0} // MD5
+	for c, plane := range [][]byte{img.Y, img.Cb, img.Cr} {
+		w, h, stride := sps.Width, sps.Height, img.YStride
+		if c > 0 {
+			w, h, stride = w/2, h/2, img.CStride
+		}
+		plane = plane[:cap(plane)]
+		sum := md5.New()
+		for y := 0; y < h; y++ {
+			sum.Write(plane[y*stride : y*stride+w])
+		}
+		payload = sum.Sum(payload)
+	}
+
+	// payload type 132, emulation prevented
+	rbsp := append(append([]byte{132, byte(len(payload))}, payload...), 0x80)
+	nal := []byte{40 << 1, 1} // suffix SEI
+	var zeros int
+	for _, b := range rbsp {
+		if zeros == 2 && b <= 3 {
+			nal = append(nal, 3)
+			zeros = 0
+		}
+		nal = append(nal, b)
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	return nal
+}
+
+func TestHashVerification(t *testing.T) {
+	stream := testStream(t)
+	stream = hevc.AppendAnnexB(stream[:len(stream):len(stream)], hashSEI(t, stream))
+	decode := func(stream []byte, opts ...Option) error {
+		dec, err := NewDecoder(opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer dec.Free()
+		if err := dec.PushData(stream, 0, nil); err != nil {
+			t.Fatal(err)
+		}
+		_, err = dec.DecodePicture(context.Background(), nil)
+		return err
+	}
+	if err := decode(stream, WithHashVerification(true)); err != nil {
+		t.Fatalf("DecodePicture of the intact picture: %v", err)
+	}
+
+	// a flipped byte in the middle of the slice data
+	units := splitAnnexB(stream)
+	var slice []byte
+	for _, nal := range units {
+		if hevc.NALUnitType(nal) < 32 {
+			slice = nal
+		}
+	}
+	corrupt := append([]byte(nil), stream...)
+	corrupt[bytes.Index(stream, slice)+len(slice)/2] ^= 0xff
+
+	err := decode(corrupt, WithHashVerification(true))
+	var de *Error
+	if !errors.Is(err, ErrChecksumMismatch) || !errors.As(err, &de) || de.Code != CodeChecksumMismatch {
+		t.Errorf("DecodePicture of the corrupt picture = %v; want a *Error of CodeChecksumMismatch", err)
+	}
+	if err := decode(corrupt); err != nil {
+		t.Errorf("DecodePicture of the corrupt picture without verification = %v", err)
+	}
+}
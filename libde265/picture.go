@@ -0,0 +1,144 @@
+package libde265
+
+// #include "libde265/de265.h"
+import "C"
+
+import (
+	"context"
+	"image"
+	"sync"
+)
+
+// Picture is a decoded picture. Unless the decoder copies pictures into
+// Go memory (see WithSafeEncoding), its planes are libde265's own buffers,
+// and the decoder holds on to them until the picture is released.
+//
+// A picture that is still held when its decoder decodes another one, or
+// is Reset or freed, is first copied into Go memory, so its image stays
+// valid either way. Calling Release when done with the image avoids that
+// copy.
+type Picture struct {
+	*pictureState
+}
+
+// pictureState is shared by a Picture and its decoder.
+type pictureState struct {
+	mu       sync.Mutex // the decoder may detach a picture in use elsewhere
+	img      *image.YCbCr
+	owned    bool // img is in Go memory
+	inTarget bool
+	released bool
+}
+
+// Image returns the picture's image, or nil once it was released. The
+// image stays valid until the picture is released.
+func (p *Picture) Image() *image.YCbCr {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.img
+}
+
+// InTarget reports whether the picture was decoded into the image passed
+// to SetTarget.
+func (p *Picture) InTarget() bool {
+	return p.inTarget
+}
+
+// Release gives the picture back to the decoder; its image must no longer
+// be used. Releasing a picture twice is a no-op.
+func (p *Picture) Release() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.img = nil
+	p.released = true
+}
+
+// Detach copies the picture's image into Go memory, unless it is there
+// already, and returns it. The image then no longer refers to the
+// decoder's buffers, so it stays valid after the picture is released.
+func (p *Picture) Detach() *image.YCbCr {
+	p.detach()
+	return p.Image()
+}
+
+// detach copies the image into Go memory unless it was released or is
+// there already.
+func (p *pictureState) detach() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.released || p.owned {
+		return
+	}
+	p.img.Y = append([]byte(nil), p.img.Y...)
+	p.img.Cb = append([]byte(nil), p.img.Cb...)
+	p.img.Cr = append([]byte(nil), p.img.Cr...)
+	p.owned = true
+}
+
+// releasePicture hands the current picture back to libde265, copying it
+// first if it is still in use.
+func (dec *Decoder) releasePicture() {
+	if dec.picture == nil {
+		return
+	}
+	dec.picture.detach()
+	dec.picture = nil
+	C.de265_release_next_picture(dec.ctx)
+}
+
+// DecodePicture decodes data, which is pushed like by Push, and returns
+// the first picture. The check of ctx happens between calls to
+// de265_decode; the decoder must be Reset before it is used again.
+func (dec *Decoder) DecodePicture(ctx context.Context, data []byte) (*Picture, error) {
+	dec.releasePicture()
+
+	if len(data) > 0 {
+		if err := dec.Push(data); err != nil {
+			return nil, err
+		}
+	}
+
+	if ret := C.de265_flush_data(dec.ctx); ret != C.DE265_OK {
+		return nil, &Error{Op: "de265_flush_data", Code: Code(ret)}
+	}
+
+	var more C.int = 1
+	for more != 0 {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		if decerr := C.de265_decode(dec.ctx, &more); decerr != C.DE265_OK {
+			return nil, &Error{Op: "de265_decode", Code: Code(decerr)}
+		}
+
+		if err := dec.collectWarnings(); err != nil {
+			return nil, err
+		}
+
+		if img := C.de265_get_next_picture(dec.ctx); img != nil {
+			if dec.alloc != nil {
+				if ycc, inTarget, ok := dec.alloc.picture(img); ok {
+					C.de265_release_next_picture(dec.ctx)
+					return &Picture{&pictureState{img: ycc, owned: true, inTarget: inTarget}}, nil
+				}
+			}
+
+			ycc, err := toYCbCr(img, dec.safeEncode)
+			if err != nil {
+				C.de265_release_next_picture(dec.ctx)
+				return nil, err
+			}
+			if dec.safeEncode {
+				C.de265_release_next_picture(dec.ctx)
+				return &Picture{&pictureState{img: ycc, owned: true}}, nil
+			}
+
+			pic := &Picture{&pictureState{img: ycc}}
+			dec.picture = pic.pictureState
+			return pic, nil
+		}
+	}
+
+	return nil, ErrNoPicture
+}
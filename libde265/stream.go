@@ -0,0 +1,186 @@
+package libde265
+
+// #include <stdint.h>
+// #include "libde265/de265.h"
+//
+// static void* token_to_ptr(uintptr_t t) { return (void*)t; }
+import "C"
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"unsafe"
+)
+
+// ErrNeedMoreData is returned by NextFrame when no picture can be output
+// until more data is pushed, or the stream is flushed.
+var ErrNeedMoreData = errors.New("libde265: need more data")
+
+// Frame is a picture output by NextFrame.
+type Frame struct {
+	Image    *image.YCbCr
+	PTS      int64       // of the data the picture was decoded from
+	UserData interface{} // as passed with that data
+}
+
+// PushData pushes a chunk of an Annex-B byte stream, i.e. NAL units
+// separated by start codes. Chunks need not end on NAL unit boundaries.
+// pts and userData are attached to the pictures starting in this chunk.
+func (dec *Decoder) PushData(data []byte, pts int64, userData interface{}) error {
+	if len(data) == 0 {
+		return nil
+	}
+	ret := C.de265_push_data(dec.ctx, unsafe.Pointer(&data[0]), C.int(len(data)), C.de265_PTS(pts), dec.token(userData))
+	if ret != C.DE265_OK {
+		return &Error{Op: "de265_push_data", Code: Code(ret)}
+	}
+	return nil
+}
+
+// PushNAL pushes a single NAL unit without start code or length prefix.
+func (dec *Decoder) PushNAL(data []byte, pts int64, userData interface{}) error {
+	if len(data) == 0 {
+		return fmt.Errorf("%w: empty NAL unit", ErrInvalidNAL)
+	}
+	return dec.pushNAL(data, pts, dec.token(userData))
+}
+
+func (dec *Decoder) pushNAL(data []byte, pts int64, token unsafe.Pointer) error {
+	ret := C.de265_push_NAL(dec.ctx, unsafe.Pointer(&data[0]), C.int(len(data)), C.de265_PTS(pts), token)
+	if ret != C.DE265_OK {
+		return &Error{Op: "de265_push_NAL", Code: Code(ret)}
+	}
+	return nil
+}
+
+// PushLengthPrefixed pushes NAL units each preceded by a big-endian length
+// of lengthSize (1, 2 or 4) bytes, as stored in MP4 samples and HEIF items.
+func (dec *Decoder) PushLengthPrefixed(data []byte, lengthSize int, pts int64, userData interface{}) error {
+	if lengthSize != 1 && lengthSize != 2 && lengthSize != 4 {
+		return fmt.Errorf("%w: length size %d", ErrInvalidNAL, lengthSize)
+	}
+
+	token := dec.token(userData)
+	var pos int
+	totalSize := len(data)
+	for pos < totalSize {
+		if pos+lengthSize > totalSize {
+			return ErrInvalidNAL
+		}
+
+		var nalSize int
+		for _, b := range data[pos : pos+lengthSize] {
+			nalSize = nalSize<<8 | int(b)
+		}
+		pos += lengthSize
+
+		if pos+nalSize > totalSize {
+			return fmt.Errorf("%w: NAL size %d", ErrInvalidNAL, nalSize)
+		}
+
+		if nalSize > 0 {
+			if err := dec.pushNAL(data[pos:pos+nalSize], pts, token); err != nil {
+				return err
+			}
+		}
+		pos += nalSize
+	}
+
+	return nil
+}
+
+// PushEndOfFrame marks the end of the data of a picture, so it can be
+// decoded without waiting for the next one.
+func (dec *Decoder) PushEndOfFrame() {
+	C.de265_push_end_of_frame(dec.ctx)
+}
+
+// Flush marks the end of the stream. NextFrame then outputs the remaining
+// pictures and returns io.EOF. The decoder must be Reset before more data
+// is pushed.
+func (dec *Decoder) Flush() error {
+	if ret := C.de265_flush_data(dec.ctx); ret != C.DE265_OK {
+		return &Error{Op: "de265_flush_data", Code: Code(ret)}
+	}
+	dec.flushed = true
+	return nil
+}
+
+// NextFrame decodes the pushed data up to the next picture in display
+// order. It returns ErrNeedMoreData when more data must be pushed first,
+// and io.EOF once a flushed stream has no pictures left. The picture is
+// always in Go memory, copied unless WithGoAllocation is used.
+//
+// The check of ctx happens between calls to de265_decode.
+func (dec *Decoder) NextFrame(ctx context.Context) (*Frame, error) {
+	dec.releasePicture()
+
+	for {
+		if img := C.de265_get_next_picture(dec.ctx); img != nil {
+			return dec.frame(img)
+		}
+
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		var more C.int
+		ret := C.de265_decode(dec.ctx, &more)
+		if err := dec.collectWarnings(); err != nil {
+			return nil, err
+		}
+		switch {
+		case ret == C.DE265_ERROR_WAITING_FOR_INPUT_DATA:
+			return nil, ErrNeedMoreData
+		case ret != C.DE265_OK:
+			return nil, &Error{Op: "de265_decode", Code: Code(ret)}
+		case more == 0:
+			if img := C.de265_get_next_picture(dec.ctx); img != nil {
+				return dec.frame(img)
+			}
+			if dec.flushed {
+				return nil, io.EOF
+			}
+			return nil, ErrNeedMoreData
+		}
+	}
+}
+
+func (dec *Decoder) frame(img *C.struct_de265_image) (*Frame, error) {
+	defer C.de265_release_next_picture(dec.ctx)
+
+	var ycc *image.YCbCr
+	if dec.alloc != nil {
+		ycc, _, _ = dec.alloc.picture(img)
+	}
+	if ycc == nil {
+		var err error
+		if ycc, err = toYCbCr(img, true); err != nil {
+			return nil, err
+		}
+	}
+	f := &Frame{Image: ycc, PTS: int64(C.de265_get_image_PTS(img))}
+	if t := uintptr(C.de265_get_image_user_data(img)); t != 0 {
+		f.UserData = dec.userData[t]
+		delete(dec.userData, t)
+	}
+	return f, nil
+}
+
+// token returns the value passed to libde265 for userData. Go pointers
+// cannot be kept by C, so the data stays in a map until its picture is
+// output or the decoder is Reset.
+func (dec *Decoder) token(userData interface{}) unsafe.Pointer {
+	if userData == nil {
+		return nil
+	}
+	if dec.userData == nil {
+		dec.userData = make(map[uintptr]interface{})
+	}
+	dec.nextToken++
+	dec.userData[dec.nextToken] = userData
+	return C.token_to_ptr(C.uintptr_t(dec.nextToken))
+}
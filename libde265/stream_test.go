@@ -0,0 +1,155 @@
+package libde265
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+)
+
+// frames returns the frames NextFrame outputs until it returns an error,
+// and that error.
+func frames(t *testing.T, dec *Decoder) ([]*Frame, error) {
+	t.Helper()
+	var fs []*Frame
+	for {
+		f, err := dec.NextFrame(context.Background())
+		if err != nil {
+			return fs, err
+		}
+		fs = append(fs, f)
+	}
+}
+
+func TestStream(t *testing.T) {
+	stream := testStream(t)
+	want := decodeStream(t, stream, WithSafeEncoding(true)).Image()
+
+	dec, err := NewDecoder()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dec.Free()
+
+	// the same picture three times, each an IDR picture of its own
+	for i := 0; i < 3; i++ {
+		if err := dec.PushData(stream, int64(10*i), i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := frames(t, dec)
+	if !errors.Is(err, ErrNeedMoreData) {
+		t.Fatalf("NextFrame before Flush = %v; want ErrNeedMoreData", err)
+	}
+	if err := dec.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	rest, err := frames(t, dec)
+	if err != io.EOF {
+		t.Fatalf("NextFrame after Flush = %v; want io.EOF", err)
+	}
+	got = append(got, rest...)
+
+	if len(got) != 3 {
+		t.Fatalf("%d frames; want 3", len(got))
+	}
+	for i, f := range got {
+		if f.PTS != int64(10*i) || f.UserData != i {
+			t.Errorf("frame %d: PTS %d, user data %v; want %d, %d", i, f.PTS, f.UserData, 10*i, i)
+		}
+		if !sameLuma(f.Image, want) {
+			t.Errorf("frame %d differs from the picture", i)
+		}
+	}
+}
+
+func TestStreamReset(t *testing.T) {
+	stream := testStream(t)
+
+	dec, err := NewDecoder()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dec.Free()
+
+	// the first picture is dropped along with its user data
+	if err := dec.PushData(stream, 1, "dropped"); err != nil {
+		t.Fatal(err)
+	}
+	dec.Reset()
+	if len(dec.userData) != 0 {
+		t.Errorf("user data of %d pictures left after Reset", len(dec.userData))
+	}
+
+	// NAL units one by one, with the end of the picture marked
+	units := splitAnnexB(stream)
+	for _, nal := range units {
+		if err := dec.PushNAL(nal, 2, "kept"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dec.PushEndOfFrame()
+	if err := dec.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := frames(t, dec)
+	if err != io.EOF {
+		t.Fatalf("NextFrame after Flush = %v; want io.EOF", err)
+	}
+	if len(got) != 1 || got[0].PTS != 2 || got[0].UserData != "kept" {
+		t.Fatalf("frames %+v; want one of PTS 2 and user data \"kept\"", got)
+	}
+
+	// flushed, the decoder takes more data only after a Reset
+	dec.Reset()
+	if err := dec.PushData(stream, 3, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := dec.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	got, err = frames(t, dec)
+	if err != io.EOF || len(got) != 1 || got[0].PTS != 3 || got[0].UserData != nil {
+		t.Fatalf("frames %+v, %v after Reset; want one of PTS 3", got, err)
+	}
+}
+
+func TestPushLengthPrefixed(t *testing.T) {
+	dec, err := NewDecoder()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dec.Free()
+	for _, tt := range []struct {
+		data []byte
+		size int
+	}{
+		{[]byte{0, 1, 0x40}, 3},
+		{[]byte{0, 0, 0, 9, 0x40}, 4},
+		{[]byte{0}, 2},
+	} {
+		if err := dec.PushLengthPrefixed(tt.data, tt.size, 0, nil); !errors.Is(err, ErrInvalidNAL) {
+			t.Errorf("PushLengthPrefixed(%x, %d) = %v; want ErrInvalidNAL", tt.data, tt.size, err)
+		}
+	}
+}
+
+// splitAnnexB returns the NAL units of an Annex-B stream with four byte
+// start codes, as written by hevc.AppendAnnexB.
+func splitAnnexB(stream []byte) [][]byte {
+	var units [][]byte
+	start := -1
+	for i := 0; i+4 <= len(stream); i++ {
+		if stream[i] == 0 && stream[i+1] == 0 && stream[i+2] == 0 && stream[i+3] == 1 {
+			if start >= 0 {
+				units = append(units, stream[start:i])
+			}
+			start = i + 4
+			i += 3
+		}
+	}
+	if start >= 0 {
+		units = append(units, stream[start:])
+	}
+	return units
+}
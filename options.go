@@ -0,0 +1,114 @@
+package goheif
+
+import (
+	"fmt"
+
+	"github.com/jdeng/goheif/heif"
+	"github.com/jdeng/goheif/libde265"
+)
+
+// PixelFormat selects the type of image returned by DecodeWithOptions.
+type PixelFormat int
+
+const (
+	// PixelFormatYCbCr returns the decoder output as an *image.YCbCr.
+	PixelFormatYCbCr PixelFormat = iota
+	// PixelFormatRGBA converts the decoder output to an *image.RGBA.
+	PixelFormatRGBA
+	// PixelFormatGray returns only the luma plane as an *image.Gray.
+	PixelFormatGray
+)
+
+// Limits bounds the resources a single decode may use, for use with
+// untrusted input. Exceeding a limit fails the decode with an error
+// wrapping ErrLimitExceeded before the offending allocation is made.
+//
+// A zero field takes its default value: no limit for MaxPixels and
+// MaxTiles, and the value from heif.DefaultLimits for the others.
+// A negative field means no limit.
+type Limits struct {
+	MaxPixels       int64 // width*height of the output and every coded image
+	MaxTiles        int   // number of tiles in a grid image
+	MaxItemDataSize int64 // bytes of coded data in a single item
+	MaxTotalBytes   int64 // item data plus (estimated) pixel buffers
+	MaxBoxes        int   // number of boxes in the file's metadata
+
+	// MaxMetadataBytes bounds the box data held in memory while parsing
+	// the file's metadata.
+	MaxMetadataBytes int64
+}
+
+func (l *Limits) heif() heif.Limits {
+	return heif.Limits{
+		MaxItemDataSize:  l.MaxItemDataSize,
+		MaxTotalBytes:    l.MaxTotalBytes,
+		MaxBoxes:         l.MaxBoxes,
+		MaxMetadataBytes: l.MaxMetadataBytes,
+	}
+}
+
+// DecodeOptions controls a single call to DecodeWithOptions.
+// The zero value decodes the same way as Decode.
+type DecodeOptions struct {
+	// SafeEncoding copies the decoded planes into Go memory instead
+	// of referencing libde265's buffers. It uses more memory but
+	// seems to make the library safer to use in containers.
+	SafeEncoding bool
+
+	// ApplyTransformations rotates and mirrors the image as described
+	// by the primary item's irot and imir properties.
+	ApplyTransformations bool
+
+	// Threads is the number of grid tiles decoded concurrently, each
+	// with its own decoder. Values below 2 decode tiles one by one.
+	Threads int
+
+	// DecoderThreads is the number of libde265 worker threads started
+	// for each decoder, which parallelize the decoding of a single
+	// image or tile when it was encoded with WPP or HEVC tiles.
+	// With worker threads, images are decoded into Go memory, and grid
+	// tiles straight into the output image where possible. Without
+	// them, libde265 decodes into its own buffers, which are copied;
+	// see BenchmarkDecodeWithOptions for the cost. The default, 0, uses
+	// no worker threads.
+	DecoderThreads int
+
+	// VerifyHash checks every decoded image and tile against the
+	// decoded picture hash SEI message of its bitstream, if present.
+	// A mismatch fails the decode with an error wrapping
+	// ErrChecksumMismatch.
+	VerifyHash bool
+
+	// FastPreview skips the deblocking and SAO in-loop filters. It
+	// speeds up decoding at the cost of some blockiness, which is fine
+	// for thumbnails and contact sheets. It cannot be combined with
+	// VerifyHash; the decode then fails with an error wrapping
+	// ErrInvalidOptions.
+	FastPreview bool
+
+	Limits Limits
+	Format PixelFormat
+
+	// OnWarning, if non-nil, is called with every warning as it is
+	// reported. Calls are serialized, even when decoding tiles
+	// concurrently.
+	OnWarning func(Warning)
+}
+
+// Warning is a non-fatal problem reported while decoding an item.
+type Warning struct {
+	ItemID uint32
+	Code   libde265.Code
+	Text   string
+}
+
+func (w Warning) String() string {
+	return fmt.Sprintf("item %d: %s", w.ItemID, w.Text)
+}
+
+func (o *DecodeOptions) threads() int {
+	if o.Threads < 1 {
+		return 1
+	}
+	return o.Threads
+}
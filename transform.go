@@ -0,0 +1,213 @@
+package goheif
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+
+	"github.com/jdeng/goheif/heif"
+	"github.com/jdeng/goheif/heif/bmff"
+)
+
+// chromaSize returns the dimensions of the chroma planes for an image
+// of the given bounds, mirroring what image.NewYCbCr allocates.
+func chromaSize(r image.Rectangle, ratio image.YCbCrSubsampleRatio) (int, int) {
+	w, h := r.Dx(), r.Dy()
+	switch ratio {
+	case image.YCbCrSubsampleRatio422:
+		return (r.Max.X+1)/2 - r.Min.X/2, h
+	case image.YCbCrSubsampleRatio420:
+		return (r.Max.X+1)/2 - r.Min.X/2, (r.Max.Y+1)/2 - r.Min.Y/2
+	case image.YCbCrSubsampleRatio440:
+		return w, (r.Max.Y+1)/2 - r.Min.Y/2
+	case image.YCbCrSubsampleRatio411:
+		return (r.Max.X+3)/4 - r.Min.X/4, h
+	case image.YCbCrSubsampleRatio410:
+		return (r.Max.X+3)/4 - r.Min.X/4, (r.Max.Y+1)/2 - r.Min.Y/2
+	}
+	return w, h
+}
+
+// subsampling returns the number of pixels per chroma sample across and
+// down.
+func subsampling(ratio image.YCbCrSubsampleRatio) (int, int) {
+	switch ratio {
+	case image.YCbCrSubsampleRatio422:
+		return 2, 1
+	case image.YCbCrSubsampleRatio420:
+		return 2, 2
+	case image.YCbCrSubsampleRatio440:
+		return 1, 2
+	case image.YCbCrSubsampleRatio411:
+		return 4, 1
+	case image.YCbCrSubsampleRatio410:
+		return 4, 2
+	}
+	return 1, 1
+}
+
+// alignYCbCr returns img, or a copy of it at the origin if its first
+// pixel is not the first of a chroma sample, as in a subimage at odd
+// coordinates. The chroma samples of the copy are those of the pixels
+// they start at.
+func alignYCbCr(img *image.YCbCr) *image.YCbCr {
+	r := img.Rect
+	sx, sy := subsampling(img.SubsampleRatio)
+	if r.Min.X%sx == 0 && r.Min.Y%sy == 0 {
+		return img
+	}
+	out := image.NewYCbCr(image.Rect(0, 0, r.Dx(), r.Dy()), img.SubsampleRatio)
+	for y := 0; y < r.Dy(); y++ {
+		off := img.YOffset(r.Min.X, r.Min.Y+y)
+		copy(out.Y[y*out.YStride:], img.Y[off:off+r.Dx()])
+	}
+	for y := 0; y < r.Dy(); y += sy {
+		for x := 0; x < r.Dx(); x += sx {
+			i, j := out.COffset(x, y), img.COffset(r.Min.X+x, r.Min.Y+y)
+			out.Cb[i], out.Cr[i] = img.Cb[j], img.Cr[j]
+		}
+	}
+	return out
+}
+
+// transposedRatio returns the subsample ratio of an image rotated by
+// 90 degrees.
+func transposedRatio(ratio image.YCbCrSubsampleRatio) (image.YCbCrSubsampleRatio, bool) {
+	switch ratio {
+	case image.YCbCrSubsampleRatio444, image.YCbCrSubsampleRatio420:
+		return ratio, true
+	case image.YCbCrSubsampleRatio422:
+		return image.YCbCrSubsampleRatio440, true
+	case image.YCbCrSubsampleRatio440:
+		return image.YCbCrSubsampleRatio422, true
+	}
+	return ratio, false
+}
+
+// planeMapper maps a sample position in a w x h source plane to its
+// position in the destination plane.
+type planeMapper func(x, y, w, h int) (int, int)
+
+func rotateMapper(angle int) planeMapper {
+	switch angle {
+	case 1: // 90 degrees counter-clockwise
+		return func(x, y, w, h int) (int, int) { return y, w - 1 - x }
+	case 2:
+		return func(x, y, w, h int) (int, int) { return w - 1 - x, h - 1 - y }
+	case 3: // 90 degrees clockwise
+		return func(x, y, w, h int) (int, int) { return h - 1 - y, x }
+	}
+	return func(x, y, w, h int) (int, int) { return x, y }
+}
+
+func mirrorMapper(axis uint8) planeMapper {
+	if axis == bmff.MirrorHorizontal {
+		return func(x, y, w, h int) (int, int) { return x, h - 1 - y }
+	}
+	return func(x, y, w, h int) (int, int) { return w - 1 - x, y }
+}
+
+func transformPlane(dst []byte, dstStride int, src []byte, srcStride, w, h int, m planeMapper) {
+	for y := 0; y < h; y++ {
+		row := src[y*srcStride : y*srcStride+w]
+		for x, v := range row {
+			dx, dy := m(x, y, w, h)
+			dst[dy*dstStride+dx] = v
+		}
+	}
+}
+
+// transformYCbCr returns a copy of img with every plane remapped by m.
+// swap is set when m exchanges the width and height of the image.
+func transformYCbCr(img *image.YCbCr, m planeMapper, swap bool) (*image.YCbCr, error) {
+	img = alignYCbCr(img)
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+	ratio := img.SubsampleRatio
+	rect := image.Rect(0, 0, w, h)
+	if swap {
+		var ok bool
+		if ratio, ok = transposedRatio(ratio); !ok {
+			return nil, fmt.Errorf("Unsupported subsample ratio for rotation %v: %w", img.SubsampleRatio, ErrUnsupported)
+		}
+		rect = image.Rect(0, 0, h, w)
+	}
+	out := image.NewYCbCr(rect, ratio)
+
+	yoff := img.YOffset(img.Rect.Min.X, img.Rect.Min.Y)
+	transformPlane(out.Y, out.YStride, img.Y[yoff:], img.YStride, w, h, m)
+
+	// the planes of out are at the origin
+	cw, ch := chromaSize(image.Rect(0, 0, w, h), img.SubsampleRatio)
+	coff := img.COffset(img.Rect.Min.X, img.Rect.Min.Y)
+	transformPlane(out.Cb, out.CStride, img.Cb[coff:], img.CStride, cw, ch, m)
+	transformPlane(out.Cr, out.CStride, img.Cr[coff:], img.CStride, cw, ch, m)
+	return out, nil
+}
+
+// cleanAperture returns the crop of an item of the given size by its clap
+// property, or the whole image if there is none.
+func cleanAperture(item *heif.Item, width, height int) (image.Rectangle, error) {
+	for _, p := range item.Properties {
+		if clap, ok := p.(*bmff.CleanAperture); ok {
+			r, ok := clap.Rect(width, height)
+			if !ok {
+				return r, &heif.ItemError{ItemID: item.ID, Err: fmt.Errorf("Invalid clap for %dx%d: %w", width, height, ErrCorrupt)}
+			}
+			return r, nil
+		}
+	}
+	return image.Rect(0, 0, width, height), nil
+}
+
+// applyCleanAperture crops the image by the clap property of the item.
+// The crop shares the planes of img, and keeps its position in it.
+func applyCleanAperture(img *image.YCbCr, item *heif.Item) (*image.YCbCr, error) {
+	r, err := cleanAperture(item, img.Rect.Dx(), img.Rect.Dy())
+	if err != nil {
+		return nil, err
+	}
+	return img.SubImage(r.Add(img.Rect.Min)).(*image.YCbCr), nil
+}
+
+// applyTransformations applies the irot and imir properties of the item
+// in the order they are associated with it.
+func applyTransformations(img *image.YCbCr, item *heif.Item) (*image.YCbCr, error) {
+	var err error
+	for _, p := range item.Properties {
+		switch p := p.(type) {
+		case *bmff.ImageRotation:
+			if p.Angle == 0 {
+				continue
+			}
+			img, err = transformYCbCr(img, rotateMapper(int(p.Angle)), p.Angle != 2)
+		case *bmff.ImageMirror:
+			img, err = transformYCbCr(img, mirrorMapper(p.Mirror), false)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return img, nil
+}
+
+// convertFormat converts the decoded image to the requested pixel format.
+func convertFormat(img *image.YCbCr, format PixelFormat) (image.Image, error) {
+	switch format {
+	case PixelFormatYCbCr:
+		return img, nil
+	case PixelFormatRGBA:
+		b := img.Bounds()
+		out := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+		draw.Draw(out, out.Rect, img, b.Min, draw.Src)
+		return out, nil
+	case PixelFormatGray:
+		b := img.Bounds()
+		out := image.NewGray(image.Rect(0, 0, b.Dx(), b.Dy()))
+		for y := 0; y < b.Dy(); y++ {
+			off := img.YOffset(b.Min.X, b.Min.Y+y)
+			copy(out.Pix[y*out.Stride:(y+1)*out.Stride], img.Y[off:off+b.Dx()])
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("Unsupported pixel format %d: %w", format, ErrUnsupported)
+}